@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 var (
+	actionTimeout  time.Duration
+	actionAttempts int
+
 	actionTriggerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "natcheck_action_duration_milliseconds",
 		Help: "The time taken to trigger each action",
@@ -24,14 +32,66 @@ var (
 )
 
 func init() {
+	flag.DurationVar(&actionTimeout, "action-timeout", getEnvMs("NAT_ACTION_TIMEOUT_MS", 60000), "Default time allowed for each attempt of an action")
+	flag.IntVar(&actionAttempts, "action-attempts", getEnvInt("NAT_ACTION_ATTEMPTS", 1), "Default number of attempts for each action")
+
 	prometheus.MustRegister(actionTriggerDuration)
 	prometheus.MustRegister(actionTriggerResults)
 }
 
+const (
+	resultSuccess     = "success"
+	resultError       = "error"
+	resultTimeout     = "timeout"
+	resultCancelled   = "cancelled"
+	resultUnconfirmed = "unconfirmed"
+	resultSkipped     = "skipped"
+)
+
+// errSkipped is returned by actions that chose not to act on an event.
+var errSkipped = errors.New("skipped")
+
 type Action interface {
-	Trigger(error) error
+	Trigger(context.Context, *Event) (Result, error)
 }
 
+// actionPolicy bounds how long an action may run and how often it is retried.
+type actionPolicy struct {
+	timeout time.Duration
+	retry   backoff
+}
+
+// policyFor returns the policy for the named action. The defaults can be
+// overridden per action with NAT_ACTION_<NAME>_TIMEOUT_MS and
+// NAT_ACTION_<NAME>_ATTEMPTS, or the config file's actions section.
+func policyFor(name string) actionPolicy {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	key := "NAT_ACTION_" + envName(name)
+	p := actionPolicy{
+		timeout: getEnvMs(key+"_TIMEOUT_MS", int(actionTimeout/time.Millisecond)),
+		retry: backoff{
+			attempts: getEnvInt(key+"_ATTEMPTS", actionAttempts),
+			base:     time.Second,
+			max:      10 * time.Second,
+		},
+	}
+	if c, ok := actionConfigs[name]; ok && name != actionDefault {
+		if c.Timeout != nil {
+			p.timeout = time.Duration(*c.Timeout)
+		}
+		if c.Attempts != nil {
+			p.retry.attempts = *c.Attempts
+		}
+	}
+	return p
+}
+
+// compositePolicy is used for actions that only group other actions, which
+// apply their own policies.
+var compositePolicy = actionPolicy{retry: backoff{attempts: 1}}
+
 type FanoutAction struct {
 	actions map[string]Action
 }
@@ -48,37 +108,156 @@ func (fa *FanoutAction) AddAction(name string, action Action) {
 	}
 }
 
-func (fa *FanoutAction) Trigger(upstreamErr error) error {
-	glog.Infof("Async fanning out %v actions", len(fa.actions))
+// Trigger runs every action concurrently and waits for them all to finish.
+func (fa *FanoutAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	glog.Infof("Fanning out %v actions", len(fa.actions))
 
+	var mu sync.Mutex
+	res := Result{}
+	var wg sync.WaitGroup
 	for name, act := range fa.actions {
+		wg.Add(1)
 		go func(name string, act Action) {
-			started := time.Now()
-			err := act.Trigger(upstreamErr)
-			actionTriggerDuration.
-				WithLabelValues(subnetName, name).
-				Observe(float64(time.Now().Sub(started) / time.Millisecond))
-
-			if err != nil {
-				glog.Errorf("Action %v failed: %v", name, err)
-				actionTriggerResults.WithLabelValues(subnetName, name, "error").Inc()
-			} else {
-				glog.Infof("Action %v succeeded", name)
-				actionTriggerResults.WithLabelValues(subnetName, name, "success").Inc()
-			}
+			defer wg.Done()
+			status := runAction(ctx, name, act, policyFor(name), ev).Status
+
+			mu.Lock()
+			res[name] = status
+			mu.Unlock()
 		}(name, act)
 	}
-	return nil
+	wg.Wait()
+
+	for name, status := range res {
+		if status != resultSuccess && status != resultSkipped {
+			return res, fmt.Errorf("action %v did not succeed", name)
+		}
+	}
+	return res, nil
+}
+
+// runAction triggers a single action under its policy, records its metrics
+// and attaches its result to the event.
+func runAction(ctx context.Context, name string, act Action, policy actionPolicy, ev *Event) ActionResult {
+	started := time.Now()
+	var details Result
+	err := policy.retry.retry(ctx, isRetryableActionError, func() error {
+		var err error
+		details, err = triggerWithTimeout(ctx, act, policy.timeout, ev)
+		if err != nil && isRetryableActionError(err) {
+			glog.Warningf("Action %v attempt failed: %v", name, err)
+		}
+		return err
+	})
+	took := time.Now().Sub(started)
+	actionTriggerDuration.
+		WithLabelValues(ev.Monitor, name).
+		Observe(float64(took / time.Millisecond))
+
+	res := ActionResult{
+		Action:   name,
+		Status:   actionStatus(err),
+		Details:  details,
+		Duration: took,
+	}
+	switch res.Status {
+	case resultSuccess:
+		glog.Infof("Action %v succeeded", name)
+	case resultSkipped:
+		glog.Infof("Action %v skipped", name)
+	case resultUnconfirmed:
+		glog.Warningf("Action %v was applied but not confirmed: %v", name, err)
+	default:
+		glog.Errorf("Action %v failed with %v: %v", name, res.Status, err)
+	}
+	if err != nil && res.Status != resultSkipped {
+		res.Error = err.Error()
+	}
+	actionTriggerResults.WithLabelValues(ev.Monitor, name, res.Status).Inc()
+	audit(auditEntry{
+		Time:     started,
+		Type:     auditAction,
+		Subnet:   ev.Subnet,
+		Event:    ev.Lifecycle(),
+		From:     ev.From,
+		To:       ev.To,
+		Action:   name,
+		DryRun:   dryRun,
+		Outcome:  res.Status,
+		Error:    res.Error,
+		Result:   details,
+		Duration: took,
+	})
+
+	ev.AddResult(res)
+	return res
+}
+
+// triggerWithTimeout stops waiting for the action once the timeout passes,
+// even if the action itself ignores its context.
+func triggerWithTimeout(ctx context.Context, act Action, timeout time.Duration, ev *Event) (Result, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type outcome struct {
+		res Result
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		res, err := act.Trigger(ctx, ev)
+		done <- outcome{res, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.res, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func actionStatus(err error) string {
+	cause := errors.Cause(err)
+	if _, ok := cause.(unconfirmedError); ok {
+		return resultUnconfirmed
+	}
+	switch cause {
+	case nil:
+		return resultSuccess
+	case errSkipped:
+		return resultSkipped
+	case context.DeadlineExceeded:
+		return resultTimeout
+	case context.Canceled:
+		return resultCancelled
+	}
+	return resultError
+}
+
+// isRetryableActionError reports whether another attempt may help. Changes
+// that were applied but not confirmed must not be applied twice, and an
+// exhausted budget needs a person to reset it. Nor is an action that timed
+// out retried, as triggerWithTimeout only stops waiting for it, so it may
+// still be making its change.
+func isRetryableActionError(err error) bool {
+	if _, ok := errors.Cause(err).(budgetExhaustedError); ok {
+		return false
+	}
+	return actionStatus(err) == resultError
 }
 
 type statelessAction struct {
-	f func(error) error
+	f func(context.Context, *Event) (Result, error)
 }
 
-func (s statelessAction) Trigger(err error) error {
-	return s.f(err)
+func (s statelessAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	return s.f(ctx, ev)
 }
 
-func makeAction(f func(error) error) Action {
+func makeAction(f func(context.Context, *Event) (Result, error)) Action {
 	return statelessAction{f}
 }
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	apiAddress  string
+	apiToken    secret
+	apiTLSCert  string
+	apiTLSKey   string
+	apiClientCA string
+
+	pausedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "natcheck_paused",
+		Help: "Whether automatic route changes have been paused by an operator",
+	},
+		[]string{"subnet"},
+	)
+)
+
+func init() {
+	flag.StringVar(&apiAddress, "api-address", getEnv("NAT_API_ADDRESS", ""), "Separate address for the operator API, which is otherwise served alongside the metrics")
+	secretVar(&apiToken, "api-token", "NAT_API_TOKEN", "Bearer token required by the operator API")
+	flag.StringVar(&apiTLSCert, "api-tls-cert", getEnv("NAT_API_TLS_CERT", ""), "Certificate file for serving the operator API over TLS on its own address")
+	flag.StringVar(&apiTLSKey, "api-tls-key", getEnv("NAT_API_TLS_KEY", ""), "Key file for serving the operator API over TLS on its own address")
+	flag.StringVar(&apiClientCA, "api-client-ca", getEnv("NAT_API_CLIENT_CA", ""), "CA file used to verify operator API client certificates")
+
+	prometheus.MustRegister(pausedGauge)
+}
+
+// pauseState records whether an operator has paused a monitor's automatic
+// route changes.
+type pauseState struct {
+	name  string
+	mu    sync.Mutex
+	until time.Time
+	by    string
+}
+
+func (p *pauseState) Pause(until time.Time, by string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until, p.by = until, by
+	pausedGauge.WithLabelValues(p.name).Set(1)
+}
+
+func (p *pauseState) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until, p.by = time.Time{}, ""
+	pausedGauge.WithLabelValues(p.name).Set(0)
+}
+
+// Paused returns when the pause expires, or false if there isn't one.
+func (p *pauseState) Paused(now time.Time) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.until.IsZero() {
+		return time.Time{}, false
+	}
+	if !now.Before(p.until) {
+		glog.Infof("Pause by %v expired", p.by)
+		p.until, p.by = time.Time{}, ""
+		pausedGauge.WithLabelValues(p.name).Set(0)
+		return time.Time{}, false
+	}
+	return p.until, true
+}
+
+// By returns who paused automatic actions.
+func (p *pauseState) By() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.by
+}
+
+// unlessPaused stops automatic actions while an operator has paused them.
+func unlessPaused(p *pauseState, cond Condition) Condition {
+	return func(ev *Event) bool {
+		if until, ok := p.Paused(ev.Time); ok {
+			glog.Warningf("Automatic actions are paused until %v", until)
+			return false
+		}
+		return cond == nil || cond(ev)
+	}
+}
+
+// apiError carries the HTTP status for requests that can't be carried out.
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e apiError) Error() string {
+	return e.msg
+}
+
+// operatorAPI lets operators act through the monitors, so that their idea of
+// the route table and incident state stays accurate. Requests name the
+// monitor they are for with the monitor parameter, which may be left out if
+// there is only one.
+type operatorAPI struct {
+	ctx       context.Context
+	monitors  *monitorSet
+	notifiers *notifiers
+	token     *secret
+}
+
+// serveOperatorAPI registers the API on mux, or serves it on its own address
+// if one is configured. The API is only enabled when some form of
+// authentication is configured.
+func serveOperatorAPI(mux *http.ServeMux, api *operatorAPI) {
+	if apiToken.Get() == "" && apiClientCA == "" {
+		glog.Infof("Skipping operator API due to absent configuration")
+		return
+	}
+	if apiClientCA != "" && (apiAddress == "" || apiTLSCert == "") {
+		glog.Fatalf("Client certificate authentication requires a separate API address with TLS")
+	}
+	api.token = &apiToken
+
+	if apiAddress == "" {
+		api.register(mux)
+		return
+	}
+
+	apiMux := http.NewServeMux()
+	api.register(apiMux)
+	srv := &http.Server{Addr: apiAddress, Handler: apiMux}
+	if apiTLSCert == "" {
+		go func() {
+			glog.Fatalf("Operator API failed: %v", srv.ListenAndServe())
+		}()
+		return
+	}
+
+	srv.TLSConfig = &tls.Config{}
+	if apiClientCA != "" {
+		pem, err := ioutil.ReadFile(apiClientCA)
+		if err != nil {
+			glog.Fatalf("Failed to read API client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			glog.Fatalf("No certificates found in %v", apiClientCA)
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if apiToken.Get() != "" {
+			// Either a certificate or the token will do
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	go func() {
+		glog.Fatalf("Operator API failed: %v", srv.ListenAndServeTLS(apiTLSCert, apiTLSKey))
+	}()
+}
+
+func (a *operatorAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/failover", a.handle("failover", a.failover))
+	mux.HandleFunc("/api/failback", a.handle("failback", a.failback))
+	mux.HandleFunc("/api/pause", a.handle("pause", a.pause))
+	mux.HandleFunc("/api/resume", a.handle("resume", a.resume))
+	mux.HandleFunc("/api/silence", a.handle("silence", a.silence))
+	mux.HandleFunc("/api/unsilence", a.handle("unsilence", a.unsilence))
+	mux.HandleFunc("/api/ack", a.handle("ack", a.ack))
+	mux.HandleFunc("/api/budget/reset", a.handle("budget-reset", a.resetBudget))
+}
+
+// authenticate returns who made the request.
+func (a *operatorAPI) authenticate(r *http.Request) (string, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	if token := a.token.Get(); token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1 {
+			return "token", true
+		}
+	}
+	return "", false
+}
+
+type apiResponse struct {
+	Action string `json:"action"`
+	DryRun bool   `json:"dryRun"`
+	Result Result `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handle authenticates and audits a request before running the operation.
+func (a *operatorAPI) handle(action string, op func(r *http.Request, actor string) (Result, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := auditEntry{
+			Time:   time.Now(),
+			Type:   auditAPI,
+			Remote: r.RemoteAddr,
+			Action: action,
+			DryRun: dryRun,
+		}
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		r.ParseForm()
+		if len(r.Form) > 0 {
+			entry.Params = make(map[string]string)
+			for name := range r.Form {
+				entry.Params[name] = r.Form.Get(name)
+			}
+		}
+
+		actor, ok := a.authenticate(r)
+		if !ok {
+			entry.Outcome = "denied"
+			audit(entry)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		entry.Actor = actor
+		if m, err := a.monitors.Get(r.FormValue("monitor")); err == nil {
+			entry.Subnet = m.Subnet
+		}
+
+		res, err := op(r, actor)
+		entry.Result = res
+		resp := apiResponse{Action: action, DryRun: dryRun, Result: res}
+		code := http.StatusOK
+		entry.Outcome = resultSuccess
+		if err != nil {
+			entry.Outcome, entry.Error, resp.Error = resultError, err.Error(), err.Error()
+			code = http.StatusInternalServerError
+			if apiErr, ok := err.(apiError); ok {
+				code = apiErr.code
+			}
+		}
+		audit(entry)
+		persisted.Save()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// monitor returns the monitor the request names.
+func (a *operatorAPI) monitor(r *http.Request) (*Monitor, error) {
+	m, err := a.monitors.Get(r.FormValue("monitor"))
+	if err != nil {
+		return nil, apiError{http.StatusNotFound, err.Error()}
+	}
+	return m, nil
+}
+
+func (a *operatorAPI) failover(r *http.Request, actor string) (Result, error) {
+	m, err := a.monitor(r)
+	if err != nil {
+		return nil, err
+	}
+	return a.changeRouteTable(m, "failover", eventFailedOver, m.Secondary, m.failover)
+}
+
+func (a *operatorAPI) failback(r *http.Request, actor string) (Result, error) {
+	m, err := a.monitor(r)
+	if err != nil {
+		return nil, err
+	}
+	return a.changeRouteTable(m, "failback", eventFailedBack, m.Primary, m.failback)
+}
+
+// externalEventWait is how long beyond a probe the API waits for a monitor
+// to take an operator event.
+const externalEventWait = 5 * time.Second
+
+// changeRouteTable makes a manual route change, and once it has been applied
+// passes the event to the health checker so that it is notified like any
+// other.
+func (a *operatorAPI) changeRouteTable(m *Monitor, name, kind, target string, change func(context.Context, *Event) (Result, error)) (Result, error) {
+	ev := m.event(kind)
+	ev.TargetRouteTable = target
+
+	name = "manual-" + name
+	res := runAction(a.ctx, name, makeAction(change), policyFor(name), ev)
+	if res.Status != resultSuccess && res.Status != resultUnconfirmed {
+		return res.Details, errors.New(res.Error)
+	}
+
+	// A reload may have stopped the monitor meanwhile, and it is only ready
+	// for the event between probes, but the change has been made regardless
+	select {
+	case m.external <- ev:
+	case <-m.done:
+		glog.Warningf("Not reporting %v of %v, which has been stopped", name, m.Name)
+	case <-time.After(time.Duration(m.Probe.Timeout) + externalEventWait):
+		glog.Warningf("Not reporting %v of %v, which is not taking events", name, m.Name)
+	case <-a.ctx.Done():
+	}
+	if res.Status == resultUnconfirmed {
+		return res.Details, errors.New(res.Error)
+	}
+	return res.Details, nil
+}
+
+func (a *operatorAPI) pause(r *http.Request, actor string) (Result, error) {
+	duration := time.Hour
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 {
+			return nil, apiError{http.StatusBadRequest, "duration must be a positive duration such as 30m"}
+		}
+	}
+
+	targets, err := a.pauseTargets(r)
+	if err != nil {
+		return nil, err
+	}
+	until := time.Now().Add(duration)
+	for _, m := range targets {
+		m.pause.Pause(until, actor)
+		glog.Warningf("Automatic actions for %v paused by %v until %v", m.Name, actor, until)
+	}
+	return Result{"until": until.UTC().Format(time.RFC3339)}, nil
+}
+
+func (a *operatorAPI) resume(r *http.Request, actor string) (Result, error) {
+	targets, err := a.pauseTargets(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range targets {
+		m.pause.Resume()
+		glog.Infof("Automatic actions for %v resumed by %v", m.Name, actor)
+	}
+	return nil, nil
+}
+
+// pauseTargets returns the named monitor, or every monitor if none is named.
+func (a *operatorAPI) pauseTargets(r *http.Request) ([]*Monitor, error) {
+	if r.FormValue("monitor") == "" {
+		return a.monitors.List(), nil
+	}
+	m, err := a.monitor(r)
+	if err != nil {
+		return nil, err
+	}
+	return []*Monitor{m}, nil
+}
+
+func (a *operatorAPI) ack(r *http.Request, actor string) (Result, error) {
+	incidents := a.notifiers.Incidents()
+	if incidents == nil {
+		return nil, apiError{http.StatusNotFound, "no incident integration is configured"}
+	}
+	m, err := a.monitor(r)
+	if err != nil {
+		return nil, err
+	}
+	return incidents.Acknowledge(a.ctx, m.Subnet)
+}
+
+func (a *operatorAPI) resetBudget(r *http.Request, actor string) (Result, error) {
+	scope := r.FormValue("scope")
+	if err := budget.Reset(scope); err != nil {
+		return nil, apiError{http.StatusNotFound, err.Error()}
+	}
+	return Result{"scope": scope}, nil
+}
+
+// silence suppresses automatic actions, and with mode=all notifications,
+// from start (default now) for duration.
+func (a *operatorAPI) silence(r *http.Request, actor string) (Result, error) {
+	start := time.Now()
+	if s := r.FormValue("start"); s != "" {
+		var err error
+		if start, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, apiError{http.StatusBadRequest, "start must be an RFC3339 timestamp"}
+		}
+	}
+	duration, err := time.ParseDuration(r.FormValue("duration"))
+	if err != nil || duration <= 0 {
+		return nil, apiError{http.StatusBadRequest, "duration must be a positive duration such as 2h"}
+	}
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = silenceActions
+	}
+
+	silence, err := silences.Add(start, start.Add(duration), mode, r.FormValue("reason"), actor)
+	if err != nil {
+		return nil, apiError{http.StatusBadRequest, err.Error()}
+	}
+	glog.Warningf("Silence %v created by %v until %v", silence.ID, actor, silence.End)
+	return Result{
+		"id":    silence.ID,
+		"start": silence.Start.UTC().Format(time.RFC3339),
+		"end":   silence.End.UTC().Format(time.RFC3339),
+		"mode":  silence.Mode,
+	}, nil
+}
+
+func (a *operatorAPI) unsilence(r *http.Request, actor string) (Result, error) {
+	id := r.FormValue("id")
+	if !silences.Remove(id) {
+		return nil, apiError{http.StatusNotFound, "no silence " + id}
+	}
+	glog.Infof("Silence %v removed by %v", id, actor)
+	return Result{"id": id}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestAPI serves the operator API for a test monitor, returning a
+// function that stops it.
+func newTestAPI(f *fakeEC2) (*Monitor, *http.ServeMux, chan *Event, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m, restoreMonitor := newTestMonitor(f)
+	m.external = make(chan *Event, 1)
+	set, restoreMonitors := withMonitors(m)
+	api := &operatorAPI{ctx: ctx, monitors: set, token: &secret{value: "s3cret"}}
+	mux := http.NewServeMux()
+	api.register(mux)
+	return m, mux, m.external, func() {
+		cancel()
+		restoreMonitors()
+		restoreMonitor()
+	}
+}
+
+func apiRequest(mux *http.ServeMux, path, token string) (int, apiResponse) {
+	req := httptest.NewRequest("POST", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	var resp apiResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestOperatorAPIRequiresToken(t *testing.T) {
+	m, mux, _, cleanup := newTestAPI(newFakeEC2())
+	defer cleanup()
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := apiRequest(mux, "/api/pause", token); code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %v", token, code)
+		}
+	}
+	if _, ok := m.pause.Paused(time.Now()); ok {
+		t.Errorf("an unauthorized request paused actions")
+	}
+}
+
+func TestOperatorAPIFailoverAndFailback(t *testing.T) {
+	m, mux, events, cleanup := newTestAPI(newFakeEC2())
+	defer cleanup()
+
+	code, resp := apiRequest(mux, "/api/failover", "s3cret")
+	if code != http.StatusOK || resp.Result["to"] != "rtb-secondary" {
+		t.Fatalf("failover: %v %+v", code, resp)
+	}
+	if ev := <-events; ev.Lifecycle() != eventFailedOver {
+		t.Errorf("expected a failed-over event, got %v", ev.Lifecycle())
+	}
+
+	if code, resp := apiRequest(mux, "/api/failover", "s3cret"); code != http.StatusInternalServerError || resp.Error == "" {
+		t.Errorf("expected a second failover to fail, got %v %+v", code, resp)
+	}
+
+	code, resp = apiRequest(mux, "/api/failback", "s3cret")
+	if code != http.StatusOK || resp.Result["to"] != "rtb-primary" {
+		t.Fatalf("failback: %v %+v", code, resp)
+	}
+	if ev := <-events; ev.Lifecycle() != eventFailedBack {
+		t.Errorf("expected a failed-back event, got %v", ev.Lifecycle())
+	}
+	if m.routeTables.Expected() != "rtb-primary" {
+		t.Errorf("expected route table rtb-primary, got %v", m.routeTables.Expected())
+	}
+
+	if code, _ := apiRequest(mux, "/api/failover?monitor=other", "s3cret"); code != http.StatusNotFound {
+		t.Errorf("expected an unknown monitor to be rejected, got %v", code)
+	}
+}
+
+func TestOperatorAPIFailoverOfStoppedMonitor(t *testing.T) {
+	m, mux, _, cleanup := newTestAPI(newFakeEC2())
+	defer cleanup()
+	m.external = make(chan *Event)
+	m.done = make(chan struct{})
+	close(m.done)
+
+	code, resp := apiRequest(mux, "/api/failover", "s3cret")
+	if code != http.StatusOK || resp.Result["to"] != "rtb-secondary" {
+		t.Errorf("expected the change to be reported, got %v %+v", code, resp)
+	}
+}
+
+func TestOperatorAPIPause(t *testing.T) {
+	m, mux, _, cleanup := newTestAPI(newFakeEC2())
+	defer cleanup()
+
+	if code, _ := apiRequest(mux, "/api/pause?duration=soon", "s3cret"); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid duration to be rejected, got %v", code)
+	}
+	if code, _ := apiRequest(mux, "/api/pause?duration=30m", "s3cret"); code != http.StatusOK {
+		t.Fatalf("pause failed with %v", code)
+	}
+
+	cond := unlessPaused(m.pause, m.failoverDue)
+	ev := &Event{From: stateHealthy, To: stateFailed, Time: time.Now()}
+	if cond(ev) {
+		t.Errorf("expected automatic actions to be paused")
+	}
+	if ev.Time = time.Now().Add(time.Hour); !cond(ev) {
+		t.Errorf("expected the pause to expire")
+	}
+
+	apiRequest(mux, "/api/pause", "s3cret")
+	apiRequest(mux, "/api/resume", "s3cret")
+	if ev.Time = time.Now(); !cond(ev) {
+		t.Errorf("expected automatic actions to resume")
+	}
+}
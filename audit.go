@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/golang/glog"
+)
+
+var (
+	auditPath     string
+	auditMaxBytes int
+	auditMaxFiles int
+	auditRecent   int
+	auditProbes   bool
+)
+
+func init() {
+	flag.StringVar(&auditPath, "audit-log", getEnv("NAT_AUDIT_LOG", ""), "File to append the JSON lines audit log to, otherwise audit entries are only logged")
+	flag.IntVar(&auditMaxBytes, "audit-max-bytes", getEnvInt("NAT_AUDIT_MAX_BYTES", 10*1024*1024), "Size at which the audit log is rotated")
+	flag.IntVar(&auditMaxFiles, "audit-max-files", getEnvInt("NAT_AUDIT_MAX_FILES", 5), "Number of rotated audit logs to keep")
+	flag.IntVar(&auditRecent, "audit-recent", getEnvInt("NAT_AUDIT_RECENT", 500), "Number of recent audit entries served on /audit")
+	flag.BoolVar(&auditProbes, "audit-probes", getEnvBool("NAT_AUDIT_PROBES", false), "Record every probe result in the audit log, so that it can be replayed by the simulate command")
+}
+
+// Audit entry types.
+const (
+	auditTransition = "transition"
+	auditAction     = "action"
+	auditEC2        = "ec2"
+	auditAPI        = "api"
+	auditProbe      = "probe"
+)
+
+// auditEntry records a decision or action taken by the monitor.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Subnet string    `json:"subnet,omitempty"`
+
+	// Transitions and the events actions were run for
+	Event string `json:"event,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+
+	// Actions, EC2 requests and operator API calls
+	Action    string            `json:"action,omitempty"`
+	Actor     string            `json:"actor,omitempty"`
+	Remote    string            `json:"remote,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Input     interface{}       `json:"input,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+
+	DryRun   bool          `json:"dryRun"`
+	Outcome  string        `json:"outcome,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Result   Result        `json:"result,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Probes
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// auditLog appends entries to a file, rotating it when it grows too large,
+// and keeps the most recent entries in memory.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int
+	maxFiles int
+	file     *os.File
+	size     int
+	recent   []auditEntry
+	next     int
+	full     bool
+}
+
+func newAuditLog(path string, maxBytes, maxFiles, recent int) (*auditLog, error) {
+	l := &auditLog{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+		recent:   make([]auditEntry, recent),
+	}
+	if path != "" {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// auditor receives every audit entry. It keeps recent entries in memory
+// until openAuditLog configures the file.
+var auditor = &auditLog{recent: make([]auditEntry, 500)}
+
+// openAuditLog configures the audit log from the flags.
+func openAuditLog() {
+	l, err := newAuditLog(auditPath, auditMaxBytes, auditMaxFiles, auditRecent)
+	if err != nil {
+		glog.Fatalf("Failed to open audit log: %v", err)
+	}
+	auditor = l
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, int(info.Size())
+	return nil
+}
+
+// rotate moves the current file to .1, shifting older files along and
+// dropping the oldest.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	for i := l.maxFiles - 1; i > 0; i-- {
+		os.Rename(l.path+"."+strconv.Itoa(i), l.path+"."+strconv.Itoa(i+1))
+	}
+	if l.maxFiles > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *auditLog) Append(e auditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		glog.Errorf("Failed to encode audit entry: %v", err)
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.recent) > 0 {
+		l.recent[l.next] = e
+		l.next = (l.next + 1) % len(l.recent)
+		l.full = l.full || l.next == 0
+	}
+
+	if l.file == nil {
+		glog.Infof("AUDIT %s", b[:len(b)-1])
+		return
+	}
+	if l.maxBytes > 0 && l.size > 0 && l.size+len(b) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			glog.Errorf("Failed to rotate audit log: %v", err)
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += n
+	if err != nil {
+		glog.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// Recent returns up to limit of the most recent entries of the given type,
+// or of any type, oldest first.
+func (l *auditLog) Recent(limit int, kind string) []auditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var all []auditEntry
+	if l.full {
+		all = append(all, l.recent[l.next:]...)
+	}
+	all = append(all, l.recent[:l.next]...)
+
+	entries := []auditEntry{}
+	for i := len(all) - 1; i >= 0 && (limit <= 0 || len(entries) < limit); i-- {
+		if kind == "" || all[i].Type == kind {
+			entries = append(entries, all[i])
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+func audit(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	auditor.Append(e)
+}
+
+// recordProbe audits a probe result if probes are being recorded.
+func recordProbe(subnet string, probe ProbeResult) {
+	if !auditProbes {
+		return
+	}
+	e := auditEntry{
+		Time:    probe.Time,
+		Type:    auditProbe,
+		Subnet:  subnet,
+		Outcome: resultSuccess,
+		Error:   probe.Error,
+		Latency: probe.Latency,
+	}
+	if probe.Error != "" {
+		e.Outcome = resultError
+	}
+	audit(e)
+}
+
+// auditHandler serves recent entries, optionally filtered with type and
+// limited with limit.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(auditor.Recent(limit, r.FormValue("type")))
+}
+
+// auditEC2Requests records every EC2 request that changes something, along
+// with its request ID, once its response has been read, or once signing or
+// sending it has failed, as the SDK has no handler that runs in every case.
+func auditEC2Requests(h *request.Handlers, subnet string) {
+	record := func(r *request.Request) {
+		if strings.HasPrefix(r.Operation.Name, "Describe") {
+			return
+		}
+		e := auditEntry{
+			Type:      auditEC2,
+			Subnet:    subnet,
+			Action:    r.Operation.Name,
+			Input:     r.Params,
+			RequestID: r.RequestID,
+			DryRun:    requestDryRun(r.Params),
+			Outcome:   resultSuccess,
+		}
+		if r.Error != nil {
+			e.Outcome = awsErrorCode(r.Error)
+			e.Error = r.Error.Error()
+		}
+		audit(e)
+	}
+	recordFailure := func(r *request.Request) {
+		if r.Error != nil {
+			record(r)
+		}
+	}
+	h.Sign.PushBack(recordFailure)
+	h.Send.PushBack(recordFailure)
+	h.Unmarshal.PushBack(record)
+	h.UnmarshalError.PushBack(record)
+}
+
+// requestDryRun reports whether an EC2 request was made with DryRun, which
+// validate and the operator commands force whatever -dry-run says.
+func requestDryRun(params interface{}) bool {
+	v := reflect.Indirect(reflect.ValueOf(params))
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	f := v.FieldByName("DryRun")
+	if !f.IsValid() {
+		return false
+	}
+	b, ok := f.Interface().(*bool)
+	return ok && aws.BoolValue(b)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "audit.log")
+	l, err := newAuditLog(path, 300, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Append(auditEntry{Type: auditTransition, From: stateHealthy, To: stateFailed})
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := f.Stat()
+		if info.Size() > 300 {
+			t.Errorf("%v is %v bytes, expected it to be rotated at 300", name, info.Size())
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			var e auditEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil || e.To != stateFailed {
+				t.Errorf("bad entry in %v: %s", name, s.Bytes())
+			}
+		}
+		f.Close()
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept")
+	}
+}
+
+func TestAuditLogRecent(t *testing.T) {
+	l, _ := newAuditLog("", 0, 0, 4)
+	for _, e := range []auditEntry{
+		{Type: auditAPI, Action: "pause"},
+		{Type: auditTransition, To: stateFailed},
+		{Type: auditAction, Action: "routetable"},
+		{Type: auditEC2, Action: "ReplaceRouteTableAssociation", RequestID: "req-1"},
+		{Type: auditAction, Action: "notify"},
+		{Type: auditTransition, To: stateHealthy},
+	} {
+		l.Append(e)
+	}
+
+	recent := l.Recent(0, "")
+	if len(recent) != 4 || recent[0].Action != "routetable" || recent[3].To != stateHealthy {
+		t.Errorf("expected the last 4 entries oldest first, got %+v", recent)
+	}
+	if recent := l.Recent(1, auditAction); len(recent) != 1 || recent[0].Action != "notify" {
+		t.Errorf("expected the latest action, got %+v", recent)
+	}
+	if recent := l.Recent(0, auditAPI); len(recent) != 0 {
+		t.Errorf("expected the API call to have been dropped, got %+v", recent)
+	}
+
+	old := auditor
+	auditor = l
+	defer func() { auditor = old }()
+
+	w := httptest.NewRecorder()
+	auditHandler(w, httptest.NewRequest("GET", "/audit?type=ec2", nil))
+	var served []auditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || served[0].RequestID != "req-1" {
+		t.Errorf("expected the EC2 request, got %s", w.Body.Bytes())
+	}
+}
+
+func TestAuditEC2RequestsRecordsDryRun(t *testing.T) {
+	l, _ := newAuditLog("", 0, 0, 10)
+	old, oldDryRun := auditor, dryRun
+	auditor, dryRun = l, false
+	defer func() { auditor, dryRun = old, oldDryRun }()
+
+	var h request.Handlers
+	auditEC2Requests(&h, "subnet-1")
+	for _, dry := range []bool{true, false} {
+		h.Unmarshal.Run(&request.Request{
+			Operation: &request.Operation{Name: "AssociateRouteTable"},
+			Params:    &ec2.AssociateRouteTableInput{DryRun: aws.Bool(dry)},
+		})
+	}
+
+	recent := l.Recent(0, auditEC2)
+	if len(recent) != 2 || !recent[0].DryRun || recent[1].DryRun {
+		t.Errorf("expected the requests' own DryRun, got %+v", recent)
+	}
+}
+
+func TestAuditEC2RequestsRecordsSendFailures(t *testing.T) {
+	l, _ := newAuditLog("", 0, 0, 10)
+	old := auditor
+	auditor = l
+	defer func() { auditor = old }()
+
+	var h request.Handlers
+	auditEC2Requests(&h, "subnet-1")
+	sent := &request.Request{
+		Operation: &request.Operation{Name: "DisassociateRouteTable"},
+		Params:    &ec2.DisassociateRouteTableInput{},
+	}
+	h.Send.Run(sent)
+	h.Send.Run(&request.Request{
+		Operation: &request.Operation{Name: "DisassociateRouteTable"},
+		Params:    &ec2.DisassociateRouteTableInput{},
+		Error:     awserr.New("RequestError", "send request failed", errors.New("i/o timeout")),
+	})
+
+	recent := l.Recent(0, auditEC2)
+	if len(recent) != 1 || recent[0].Outcome != "RequestError" || !strings.Contains(recent[0].Error, "i/o timeout") {
+		t.Errorf("expected only the failed send, got %+v", recent)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	budgetGlobal int
+	budgetSubnet int
+	budgetWindow time.Duration
+
+	budgetRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "natcheck_failover_budget_remaining",
+		Help: "The number of automated route changes still allowed in the budget window, by scope",
+	},
+		[]string{"scope"},
+	)
+	budgetAlertOnly = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "natcheck_failover_alert_only",
+		Help: "Whether automated route changes are disabled until the budget is reset, by scope",
+	},
+		[]string{"scope"},
+	)
+)
+
+func init() {
+	flag.IntVar(&budgetGlobal, "budget-global", getEnvInt("NAT_BUDGET_GLOBAL", 4), "Maximum automated route changes across all subnets per budget window, 0 for no limit")
+	flag.IntVar(&budgetSubnet, "budget-subnet", getEnvInt("NAT_BUDGET_SUBNET", 2), "Maximum automated route changes per subnet per budget window, 0 for no limit")
+	flag.DurationVar(&budgetWindow, "budget-window", getEnvMs("NAT_BUDGET_WINDOW_MS", 3600000), "Window over which the failover budget applies in milliseconds")
+
+	prometheus.MustRegister(budgetRemaining)
+	prometheus.MustRegister(budgetAlertOnly)
+}
+
+const budgetGlobalScope = "global"
+
+// budgetExhaustedError is returned instead of making a change once a budget
+// has run out.
+type budgetExhaustedError struct {
+	scope  string
+	limit  int
+	window time.Duration
+}
+
+func (e budgetExhaustedError) Error() string {
+	return fmt.Sprintf("%v failover budget of %v changes per %v exhausted, alerting only until it is reset", e.scope, e.limit, e.window)
+}
+
+// changeBudget limits the changes made within a sliding window. Once a change
+// is refused the budget stays exhausted until it is reset, even after the
+// window has passed, so that a person looks at what went wrong.
+type changeBudget struct {
+	scope   string
+	limit   int
+	window  time.Duration
+	changes []time.Time
+	refused bool
+}
+
+func (b *changeBudget) used(now time.Time) int {
+	recent := b.changes[:0]
+	for _, t := range b.changes {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	b.changes = recent
+	return len(b.changes)
+}
+
+func (b *changeBudget) allows(now time.Time) bool {
+	return !b.refused && (b.limit <= 0 || b.used(now) < b.limit)
+}
+
+func (b *changeBudget) updateMetrics(now time.Time) {
+	if b.limit > 0 {
+		budgetRemaining.WithLabelValues(b.scope).Set(float64(b.limit - b.used(now)))
+	}
+	alertOnly := 0.0
+	if b.refused {
+		alertOnly = 1
+	}
+	budgetAlertOnly.WithLabelValues(b.scope).Set(alertOnly)
+}
+
+// BudgetStatus describes the state of a budget for /status.
+type BudgetStatus struct {
+	Scope     string `json:"scope"`
+	Used      int    `json:"used"`
+	Limit     int    `json:"limit"`
+	AlertOnly bool   `json:"alertOnly"`
+}
+
+// failoverBudget holds the global budget and one for each subnet.
+type failoverBudget struct {
+	mu          sync.Mutex
+	global      *changeBudget
+	subnets     map[string]*changeBudget
+	subnetLimit int
+	window      time.Duration
+}
+
+func newFailoverBudget() *failoverBudget {
+	b := &failoverBudget{
+		global:      &changeBudget{scope: budgetGlobalScope, limit: budgetGlobal, window: budgetWindow},
+		subnets:     make(map[string]*changeBudget),
+		subnetLimit: budgetSubnet,
+		window:      budgetWindow,
+	}
+	b.global.updateMetrics(time.Now())
+	return b
+}
+
+// SetLimits changes the limits, keeping the changes already counted.
+func (b *failoverBudget) SetLimits(global, subnet int, window time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subnetLimit, b.window = subnet, window
+	b.global.limit, b.global.window = global, window
+	now := time.Now()
+	b.global.updateMetrics(now)
+	for _, sb := range b.subnets {
+		sb.limit, sb.window = subnet, window
+		sb.updateMetrics(now)
+	}
+}
+
+// budget is created once the flags have been parsed.
+var budget *failoverBudget
+
+func (b *failoverBudget) subnet(id string) *changeBudget {
+	sb, ok := b.subnets[id]
+	if !ok {
+		sb = &changeBudget{scope: id, limit: b.subnetLimit, window: b.window}
+		b.subnets[id] = sb
+	}
+	return sb
+}
+
+// Spend records an automated change to the subnet, or returns an error if
+// either budget doesn't allow it. Refusing a change switches that scope to
+// alert-only.
+func (b *failoverBudget) Spend(subnet string, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sb := b.subnet(subnet)
+	defer sb.updateMetrics(now)
+	defer b.global.updateMetrics(now)
+
+	for _, scope := range []*changeBudget{sb, b.global} {
+		if !scope.allows(now) {
+			scope.refused = true
+			return budgetExhaustedError{scope: scope.scope, limit: scope.limit, window: scope.window}
+		}
+	}
+	sb.changes = append(sb.changes, now)
+	b.global.changes = append(b.global.changes, now)
+	return nil
+}
+
+// Reset clears the named scope, or every scope if none is given, returning
+// the monitor to making changes automatically.
+func (b *failoverBudget) Reset(scope string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var scopes []*changeBudget
+	switch scope {
+	case "":
+		scopes = append(scopes, b.global)
+		for _, sb := range b.subnets {
+			scopes = append(scopes, sb)
+		}
+	case budgetGlobalScope:
+		scopes = append(scopes, b.global)
+	default:
+		sb, ok := b.subnets[scope]
+		if !ok {
+			return fmt.Errorf("no budget for %v", scope)
+		}
+		scopes = append(scopes, sb)
+	}
+
+	now := time.Now()
+	for _, sb := range scopes {
+		glog.Infof("Resetting %v failover budget", sb.scope)
+		sb.changes = nil
+		sb.refused = false
+		sb.updateMetrics(now)
+	}
+	return nil
+}
+
+// Status returns the state of every budget, global first.
+func (b *failoverBudget) Status() []BudgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	status := []BudgetStatus{b.global.status(now)}
+	var ids []string
+	for id := range b.subnets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		status = append(status, b.subnets[id].status(now))
+	}
+	return status
+}
+
+func (b *changeBudget) status(now time.Time) BudgetStatus {
+	return BudgetStatus{Scope: b.scope, Used: b.used(now), Limit: b.limit, AlertOnly: b.refused}
+}
+
+// BudgetUsage is the saved state of a budget.
+type BudgetUsage struct {
+	Scope     string      `json:"scope"`
+	Changes   []time.Time `json:"changes,omitempty"`
+	AlertOnly bool        `json:"alertOnly"`
+}
+
+// Usage returns the changes counted against each budget, so that they can be
+// saved across restarts.
+func (b *failoverBudget) Usage() []BudgetUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	usage := []BudgetUsage{b.global.usage()}
+	for _, sb := range b.subnets {
+		usage = append(usage, sb.usage())
+	}
+	return usage
+}
+
+func (b *changeBudget) usage() BudgetUsage {
+	return BudgetUsage{Scope: b.scope, Changes: append([]time.Time(nil), b.changes...), AlertOnly: b.refused}
+}
+
+// Restore reinstates saved usage. Limits come from the current settings.
+func (b *failoverBudget) Restore(usage []BudgetUsage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for _, u := range usage {
+		sb := b.global
+		if u.Scope != budgetGlobalScope {
+			sb = b.subnet(u.Scope)
+		}
+		sb.changes = append([]time.Time(nil), u.Changes...)
+		sb.refused = u.AlertOnly
+		sb.updateMetrics(now)
+	}
+}
+
+// budgetedAction only lets an automated change through while the budget
+// allows. Retries of the same event don't spend the budget again, and nor
+// do dry runs, which change nothing.
+type budgetedAction struct {
+	budget *failoverBudget
+	action Action
+
+	mu    sync.Mutex
+	spent *Event
+}
+
+func budgeted(b *failoverBudget, action Action) Action {
+	return &budgetedAction{budget: b, action: action}
+}
+
+func (a *budgetedAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	a.mu.Lock()
+	var err error
+	if a.spent != ev && !dryRun {
+		if err = a.budget.Spend(ev.Subnet, ev.Time); err == nil {
+			a.spent = ev
+		}
+	}
+	a.mu.Unlock()
+	if err != nil {
+		glog.Errorf("Not changing route tables: %v", err)
+		return Result{"budget": "exhausted"}, err
+	}
+	return a.action.Trigger(ctx, ev)
+}
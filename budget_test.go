@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFailoverBudgetLatchesUntilReset(t *testing.T) {
+	oldGlobal, oldSubnet := budgetGlobal, budgetSubnet
+	budgetGlobal, budgetSubnet = 3, 2
+	defer func() { budgetGlobal, budgetSubnet = oldGlobal, oldSubnet }()
+	b := newFailoverBudget()
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := b.Spend("subnet-1", now); err != nil {
+			t.Fatalf("change %v: %v", i, err)
+		}
+	}
+	if err := b.Spend("subnet-1", now); err == nil {
+		t.Fatalf("expected the subnet budget to be exhausted")
+	}
+	if err := b.Spend("subnet-2", now); err != nil {
+		t.Errorf("other subnets should still be allowed: %v", err)
+	}
+	if err := b.Spend("subnet-3", now); err == nil {
+		t.Errorf("expected the global budget to be exhausted")
+	}
+	if err := b.Spend("subnet-1", now.Add(2*budgetWindow)); err == nil {
+		t.Errorf("expected the subnet to stay alert-only after the window")
+	}
+
+	status := b.Status()
+	if len(status) != 4 || status[0].Scope != budgetGlobalScope || !status[0].AlertOnly || !status[1].AlertOnly {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	if err := b.Reset("subnet-9"); err == nil {
+		t.Errorf("expected resetting an unknown subnet to fail")
+	}
+	if err := b.Reset(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Spend("subnet-1", now); err != nil {
+		t.Errorf("expected changes to be allowed after a reset: %v", err)
+	}
+}
+
+func TestBudgetedActionSpendsOncePerEvent(t *testing.T) {
+	oldGlobal, oldSubnet := budgetGlobal, budgetSubnet
+	budgetGlobal, budgetSubnet = 0, 1
+	defer func() { budgetGlobal, budgetSubnet = oldGlobal, oldSubnet }()
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	attempts := 0
+	a := budgeted(newFailoverBudget(), makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		attempts++
+		return nil, nil
+	}))
+
+	ev := &Event{Subnet: "subnet-1", Time: time.Now()}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Trigger(context.Background(), ev); err != nil {
+			t.Fatalf("attempt %v: %v", i, err)
+		}
+	}
+
+	res := runAction(context.Background(), "routetable", a, actionPolicy{retry: backoff{attempts: 3}}, &Event{Subnet: "subnet-1", Time: time.Now()})
+	if res.Status != resultError || attempts != 3 {
+		t.Errorf("expected a single refused attempt, got %+v after %v attempts", res, attempts)
+	}
+}
+
+func TestBudgetedActionDryRunSpendsNothing(t *testing.T) {
+	oldGlobal, oldSubnet := budgetGlobal, budgetSubnet
+	budgetGlobal, budgetSubnet = 0, 1
+	defer func() { budgetGlobal, budgetSubnet = oldGlobal, oldSubnet }()
+	oldDryRun := dryRun
+	dryRun = true
+	defer func() { dryRun = oldDryRun }()
+
+	b := newFailoverBudget()
+	a := budgeted(b, makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		return nil, nil
+	}))
+	for i := 0; i < 3; i++ {
+		if _, err := a.Trigger(context.Background(), &Event{Subnet: "subnet-1", Time: time.Now()}); err != nil {
+			t.Fatalf("dry run %v: %v", i, err)
+		}
+	}
+	for _, s := range b.Status() {
+		if s.Used != 0 || s.AlertOnly {
+			t.Errorf("expected dry runs to leave the budget alone, got %+v", s)
+		}
+	}
+}
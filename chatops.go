@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	slackURL      secret
+	slackTemplate string
+	teamsURL      secret
+	teamsTemplate string
+	externalURL   string
+)
+
+func init() {
+	secretVar(&slackURL, "slack-url", "NAT_SLACK_URL", "Slack-compatible incoming webhook URL")
+	flag.StringVar(&slackTemplate, "slack-template", getEnv("NAT_SLACK_TEMPLATE", ""), "File containing a template for the Slack message body")
+	secretVar(&teamsURL, "teams-url", "NAT_TEAMS_URL", "Microsoft Teams connector URL")
+	flag.StringVar(&teamsTemplate, "teams-template", getEnv("NAT_TEAMS_TEMPLATE", ""), "File containing a template for the Teams message body")
+	flag.StringVar(&externalURL, "external-url", getEnv("NAT_EXTERNAL_URL", ""), "URL at which this monitor's HTTP endpoints can be reached, used for links in notifications")
+}
+
+const defaultSlackTemplate = `{
+  "text": {{json .Title}},
+  "attachments": [{
+    "color": {{json (printf "#%s" .Color)}},
+    "fields": [
+      {"title": "Monitor", "value": {{json .Monitor}}, "short": true},
+      {"title": "Subnet", "value": {{json .Subnet}}, "short": true},
+{{- if .Suppressed}}
+      {"title": "Suppressed", "value": {{json .SuppressedText}}, "short": false}
+{{- else}}
+      {"title": "Target", "value": {{json .Target}}, "short": true},
+      {"title": "Failures", "value": {{json (printf "%d consecutive over %v, %d of the last %d checks" .ConsecutiveFailures .FailingFor .Window.Failures .Window.Checks)}}, "short": false},
+      {"title": "Last error", "value": {{json .LastError}}, "short": false},
+      {"title": "Actions", "value": {{json .ResultsText}}, "short": false}
+{{- end}}
+    ]{{if .StatusURL}},
+    "actions": [
+      {"type": "button", "text": "Status", "url": {{json .StatusURL}}},
+      {"type": "button", "text": "Metrics", "url": {{json .MetricsURL}}}
+    ]{{end}}
+  }]
+}`
+
+const defaultTeamsTemplate = `{
+  "@type": "MessageCard",
+  "@context": "http://schema.org/extensions",
+  "themeColor": {{json .Color}},
+  "summary": {{json .Title}},
+  "title": {{json .Title}},
+  "sections": [{
+    "facts": [
+      {"name": "Monitor", "value": {{json .Monitor}}},
+      {"name": "Subnet", "value": {{json .Subnet}}}
+{{- if not .Suppressed}},
+      {"name": "Target", "value": {{json .Target}}},
+      {"name": "Failures", "value": {{json (printf "%d consecutive over %v, %d of the last %d checks" .ConsecutiveFailures .FailingFor .Window.Failures .Window.Checks)}}},
+      {"name": "Last error", "value": {{json .LastError}}}
+{{- end}}
+    ],
+    "text": {{if .Suppressed}}{{json .SuppressedText}}{{else}}{{json .ResultsText}}{{end}}
+  }]{{if .StatusURL}},
+  "potentialAction": [
+    {"@type": "OpenUri", "name": "Status", "targets": [{"os": "default", "uri": {{json .StatusURL}}}]},
+    {"@type": "OpenUri", "name": "Metrics", "targets": [{"os": "default", "uri": {{json .MetricsURL}}}]}
+  ]{{end}}
+}`
+
+var chatTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+type chatAction struct {
+	kind   string
+	url    *secret
+	tmpl   *template.Template
+	client *http.Client
+	retry  backoff
+}
+
+func makeSlackAction() (Action, error) {
+	return makeChatAction("slack", &slackURL, slackTemplate, defaultSlackTemplate)
+}
+
+func makeTeamsAction() (Action, error) {
+	return makeChatAction("teams", &teamsURL, teamsTemplate, defaultTeamsTemplate)
+}
+
+func makeChatAction(kind string, url *secret, templateFile, defaultTemplate string) (Action, error) {
+	if url.Get() == "" {
+		glog.Infof("Skipping %v action due to absent configuration", kind)
+		return nil, nil
+	}
+
+	c, err := newChatAction(kind, url, templateFile, defaultTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newChatAction(kind string, url *secret, templateFile, defaultTemplate string) (*chatAction, error) {
+	text := defaultTemplate
+	if templateFile != "" {
+		b, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %v template", kind)
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New(kind).Funcs(chatTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %v template", kind)
+	}
+
+	return &chatAction{
+		kind:   kind,
+		url:    url,
+		tmpl:   tmpl,
+		client: &http.Client{Timeout: webhookTimeout},
+		retry:  backoff{attempts: webhookAttempts, base: 500 * time.Millisecond, max: 5 * time.Second},
+	}, nil
+}
+
+// render executes the template and checks that the result is valid JSON.
+func (c *chatAction) render(ev *Event) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := c.tmpl.Execute(&buf, newNotification(ev)); err != nil {
+		return nil, errors.Wrapf(err, "rendering %v message failed", c.kind)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buf.Bytes()); err != nil {
+		return nil, errors.Wrapf(err, "%v template did not produce valid JSON", c.kind)
+	}
+	return compact.Bytes(), nil
+}
+
+func (c *chatAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	body, err := c.render(ev)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		glog.Infof("Would be posting %v message: %s", c.kind, body)
+		return Result{"delivery": "dry-run"}, nil
+	}
+
+	glog.Infof("Sending %v message", c.kind)
+	url := c.url.Get()
+	err = c.retry.retry(ctx, isRetryableWebhookError, func() error {
+		return postJSON(ctx, c.client, url, nil, body)
+	})
+	if err != nil {
+		// The URL is the credential, so keep it out of the results
+		return nil, fmt.Errorf("posting %v message failed: %v", c.kind, c.url.redact(err.Error()))
+	}
+	return Result{"delivery": "delivered"}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testEvent() *Event {
+	ev := &Event{
+		Kind:                eventFailed,
+		Monitor:             "eu-west-1a",
+		Subnet:              "subnet-1",
+		Target:              "example.com",
+		From:                stateHealthy,
+		To:                  stateFailed,
+		Time:                time.Now(),
+		ConsecutiveFailures: 5,
+		FirstFailure:        time.Now().Add(-5 * time.Second),
+		LastError:           `Check timed out after 500ms "quoted"`,
+	}
+	ev.AddResult(ActionResult{Action: "routetable", Status: resultError, Error: "throttled"})
+	return ev
+}
+
+func TestChatTemplatesRenderJSON(t *testing.T) {
+	oldURL := externalURL
+	externalURL = "http://nat.example.com:8080/"
+	defer func() { externalURL = oldURL }()
+
+	for _, kind := range []string{"slack", "teams"} {
+		tmpl := defaultSlackTemplate
+		if kind == "teams" {
+			tmpl = defaultTeamsTemplate
+		}
+		c, err := newChatAction(kind, &secret{value: "http://unused"}, "", tmpl)
+		if err != nil {
+			t.Fatalf("%v: %v", kind, err)
+		}
+
+		body, err := c.render(testEvent())
+		if err != nil {
+			t.Fatalf("%v: %v", kind, err)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Fatalf("%v: %v", kind, err)
+		}
+		if len(doc) == 0 {
+			t.Errorf("%v: unexpected body %s", kind, body)
+		}
+	}
+}
+
+func TestSlackDelivery(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	var received map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer srv.Close()
+
+	c, err := makeChatAction("slack", &secret{value: srv.URL}, "", defaultSlackTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Trigger(context.Background(), testEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if received["text"] != "eu-west-1a NAT failover FAILED" {
+		t.Errorf("unexpected message %v", received)
+	}
+}
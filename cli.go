@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+var assumeYes bool
+
+func init() {
+	flag.BoolVar(&assumeYes, "yes", false, "Make the change in the failover and failback commands without asking for confirmation")
+}
+
+// cli runs the operator commands against the configured monitors, without
+// starting them.
+type cli struct {
+	in        *bufio.Reader
+	out       io.Writer
+	newClient func(subnet string) ec2iface.EC2API
+	probe     func(host string, timeout time.Duration) error
+}
+
+func newCLI() *cli {
+	dryRun = cliDryRun()
+	return &cli{
+		in:        bufio.NewReader(os.Stdin),
+		out:       os.Stdout,
+		newClient: newEC2Client,
+		probe: func(host string, timeout time.Duration) error {
+			return <-checkEndpoint(host, timeout)
+		},
+	}
+}
+
+// cliDryRun decides whether the commands only describe changes. Operators
+// asking for a change expect it to be made, whatever the monitor's default,
+// unless -dry-run, the config file's dryRun or NAT_DRY_RUN says otherwise.
+// They take precedence in that order, as they do for the monitor.
+func cliDryRun() bool {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "dry-run" })
+	if explicit {
+		return dryRun
+	}
+	if configFile != "" {
+		cfg, err := loadConfig()
+		if err != nil {
+			// The command reports the error, so change nothing meanwhile
+			return true
+		}
+		if cfg.DryRun != nil {
+			return *cfg.DryRun
+		}
+	}
+	if os.Getenv("NAT_DRY_RUN") != "" {
+		return getEnvBool("NAT_DRY_RUN", true)
+	}
+	return false
+}
+
+func checkCommand(args []string) int    { return newCLI().check(args) }
+func statusCommand(args []string) int   { return newCLI().status(args) }
+func failoverCommand(args []string) int { return newCLI().changeRouteTable(args, "failover") }
+func failbackCommand(args []string) int { return newCLI().changeRouteTable(args, "failback") }
+
+// monitors returns the configured monitors named in args, or all of them.
+func (c *cli) monitors(args []string) ([]*Monitor, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	set := &monitorSet{monitors: map[string]*Monitor{}}
+	for _, mc := range cfg.Monitors {
+		set.monitors[mc.Name] = newMonitor(mc, c.newClient(mc.Subnet))
+	}
+	if len(args) == 0 {
+		return set.List(), nil
+	}
+
+	var ms []*Monitor
+	for _, name := range args {
+		m, err := set.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// check probes each monitor's target once, as the monitor would.
+func (c *cli) check(args []string) int {
+	ms, err := c.monitors(args)
+	if err != nil {
+		fmt.Fprintln(c.out, err)
+		return 2
+	}
+
+	status := 0
+	for _, m := range ms {
+		started := time.Now()
+		if err := c.probe(m.Probe.Target, time.Duration(m.Probe.Timeout)); err != nil {
+			fmt.Fprintf(c.out, "FAIL  %v: %v: %v\n", m.Name, m.Probe.Target, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(c.out, "OK    %v: %v answered in %v\n", m.Name, m.Probe.Target, time.Now().Sub(started))
+	}
+	return status
+}
+
+// status prints the route table each subnet is associated with.
+func (c *cli) status(args []string) int {
+	ms, err := c.monitors(args)
+	if err != nil {
+		fmt.Fprintln(c.out, err)
+		return 2
+	}
+
+	status := 0
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MONITOR\tSUBNET\tROUTE TABLE\tACTIVE")
+	for _, m := range ms {
+		ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+		current, err := m.associatedRouteTable(ctx)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(w, "%v\t%v\t%v\t\n", m.Name, m.Subnet, err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Name, m.Subnet, current, m.activeRouteTable(current))
+	}
+	w.Flush()
+	return status
+}
+
+// activeRouteTable describes which of the monitor's route tables id is.
+func (m *Monitor) activeRouteTable(id string) string {
+	switch id {
+	case m.Primary:
+		return "primary"
+	case m.Secondary:
+		return "secondary"
+	}
+	return "neither"
+}
+
+// changeRouteTable makes a manual failover or failback of the monitor named
+// in args, after asking for confirmation. With -dry-run the change is only
+// checked for permission and its plan printed.
+func (c *cli) changeRouteTable(args []string, name string) int {
+	if len(args) > 1 {
+		fmt.Fprintf(c.out, "Only one monitor can be given to %v\n", name)
+		return 2
+	}
+	ms, err := c.monitors(args)
+	if err == nil && len(ms) != 1 {
+		err = fmt.Errorf("a monitor must be named, one of %v", strings.Join(monitorNames(ms), ", "))
+	}
+	if err != nil {
+		fmt.Fprintln(c.out, err)
+		return 2
+	}
+	m := ms[0]
+
+	from, to, kind, change := m.Primary, m.Secondary, eventFailedOver, m.failover
+	if name == "failback" {
+		from, to, kind, change = m.Secondary, m.Primary, eventFailedBack, m.failback
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	current, err := m.associatedRouteTable(ctx)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(c.out, "Failed to find the route table of %v: %v\n", m.Subnet, err)
+		return 1
+	}
+	if current == to {
+		fmt.Fprintf(c.out, "%v already uses %v, so nothing was changed\n", m.Subnet, to)
+		return 0
+	}
+	if current != from {
+		fmt.Fprintf(c.out, "%v uses %v rather than %v, so nothing was changed\n", m.Subnet, current, from)
+		return 1
+	}
+
+	if !dryRun && !assumeYes && !c.confirm(fmt.Sprintf("Move %v (%v) from %v to %v?", m.Subnet, m.Name, from, to)) {
+		fmt.Fprintln(c.out, "Nothing was changed")
+		return 1
+	}
+
+	ev := m.event(kind)
+	ev.TargetRouteTable = to
+	action := "manual-" + name
+	res := runAction(context.Background(), action, makeAction(change), policyFor(action), ev)
+	fmt.Fprint(c.out, formatResults([]ActionResult{res}))
+	if res.Status != resultSuccess {
+		return 1
+	}
+	return 0
+}
+
+// confirm asks a yes or no question, taking anything but yes as no.
+func (c *cli) confirm(question string) bool {
+	fmt.Fprintf(c.out, "%v [y/N] ", question)
+	answer, _ := c.in.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func monitorNames(ms []*Monitor) []string {
+	var names []string
+	for _, m := range ms {
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	return names
+}
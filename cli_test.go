@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+func newTestCLI(c ec2iface.EC2API, answer string) (*cli, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &cli{
+		in:        bufio.NewReader(strings.NewReader(answer)),
+		out:       out,
+		newClient: func(string) ec2iface.EC2API { return c },
+		probe:     func(string, time.Duration) error { return nil },
+	}, out
+}
+
+const testCLIConfig = `{"monitors": [
+	{"name": "a", "subnet": "subnet-1", "primary": "rtb-primary", "secondary": "rtb-secondary",
+	 "probe": {"target": "localhost"}}
+]}`
+
+func TestCLIStatus(t *testing.T) {
+	defer withConfigFile(t, testCLIConfig)()
+	ec2 := newFakeEC2()
+
+	c, out := newTestCLI(ec2, "")
+	if status := c.status(nil); status != 0 {
+		t.Fatalf("got status %v:\n%v", status, out)
+	}
+	if !strings.Contains(out.String(), "rtb-primary  primary") {
+		t.Errorf("expected the primary to be active, got:\n%v", out)
+	}
+
+	c, out = newTestCLI(ec2, "")
+	if status := c.check([]string{"a"}); status != 0 || !strings.Contains(out.String(), "OK    a: localhost") {
+		t.Errorf("got status %v:\n%v", status, out)
+	}
+	if status := c.check([]string{"b"}); status != 2 {
+		t.Errorf("expected an unknown monitor to be a usage error, got %v", status)
+	}
+}
+
+func TestCLIFailover(t *testing.T) {
+	defer withConfigFile(t, testCLIConfig)()
+	ec2 := newFakeEC2()
+	_, restore := newTestMonitor(ec2)
+	defer restore()
+
+	c, out := newTestCLI(ec2, "n\n")
+	if status := c.changeRouteTable(nil, "failover"); status != 1 || ec2.associations["subnet-1"] != "rtb-primary" {
+		t.Fatalf("expected declining to change nothing, got status %v:\n%v", status, out)
+	}
+
+	c, out = newTestCLI(ec2, "y\n")
+	if status := c.changeRouteTable(nil, "failover"); status != 0 {
+		t.Fatalf("got status %v:\n%v", status, out)
+	}
+	if table := ec2.associations["subnet-1"]; table != "rtb-secondary" {
+		t.Errorf("expected the subnet to use the secondary, got %v", table)
+	}
+
+	c, out = newTestCLI(ec2, "")
+	if status := c.changeRouteTable(nil, "failover"); status != 0 || !strings.Contains(out.String(), "already uses rtb-secondary") {
+		t.Errorf("expected a repeated failover to change nothing, got status %v:\n%v", status, out)
+	}
+
+	oldDryRun := dryRun
+	dryRun = true
+	defer func() { dryRun = oldDryRun }()
+	c, out = newTestCLI(ec2, "")
+	if status := c.changeRouteTable([]string{"a"}, "failback"); status != 0 || ec2.associations["subnet-1"] != "rtb-secondary" {
+		t.Errorf("expected a dry run to change nothing, got status %v:\n%v", status, out)
+	}
+	if !strings.Contains(out.String(), "- associate rtb-primary with subnet-1") {
+		t.Errorf("expected the change to be described, got:\n%v", out)
+	}
+}
+
+func TestCLIDryRunSources(t *testing.T) {
+	oldEnv, hadEnv := os.LookupEnv("NAT_DRY_RUN")
+	defer func() {
+		if hadEnv {
+			os.Setenv("NAT_DRY_RUN", oldEnv)
+		} else {
+			os.Unsetenv("NAT_DRY_RUN")
+		}
+	}()
+
+	defer withConfigFile(t, testCLIConfig)()
+	os.Unsetenv("NAT_DRY_RUN")
+	if cliDryRun() {
+		t.Errorf("expected changes to be made by default")
+	}
+	os.Setenv("NAT_DRY_RUN", "true")
+	if !cliDryRun() {
+		t.Errorf("expected NAT_DRY_RUN to be honoured")
+	}
+
+	defer withConfigFile(t, `{"dryRun": false, "monitors": [{"name": "a", "subnet": "subnet-1", "primary": "rtb-primary", "secondary": "rtb-secondary", "probe": {"target": "localhost"}}]}`)()
+	if cliDryRun() {
+		t.Errorf("expected the config file to take precedence over NAT_DRY_RUN")
+	}
+	defer withConfigFile(t, `{"dryRun": true, "monitors": [{"name": "a", "subnet": "subnet-1", "primary": "rtb-primary", "secondary": "rtb-secondary", "probe": {"target": "localhost"}}]}`)()
+	os.Unsetenv("NAT_DRY_RUN")
+	if !cliDryRun() {
+		t.Errorf("expected the config file's dryRun to be honoured")
+	}
+}
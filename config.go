@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var configFile string
+
+func init() {
+	flag.StringVar(&configFile, "config", getEnv("NAT_CONFIG", ""), "JSON file describing the monitors, reloaded on SIGHUP. Settings it leaves out default to the flags, and flags given on the command line override its defaults")
+}
+
+// Duration is written in config files as a string such as "500ms".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations should be strings such as \"500ms\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config is the configuration file. Global settings apply to every monitor.
+type Config struct {
+	DryRun      *bool                   `json:"dryRun"`
+	Budget      *BudgetConfig           `json:"budget"`
+	Maintenance *MaintenanceConfig      `json:"maintenance"`
+	Secrets     map[string]string       `json:"secrets"`
+	Notify      *NotifyConfig           `json:"notify"`
+	Exec        *ExecConfig             `json:"exec"`
+	Actions     map[string]ActionConfig `json:"actions"`
+	Defaults    MonitorConfig           `json:"defaults"`
+	Monitors    []MonitorConfig         `json:"monitors"`
+}
+
+type BudgetConfig struct {
+	Global *int      `json:"global"`
+	Subnet *int      `json:"subnet"`
+	Window *Duration `json:"window"`
+}
+
+type MaintenanceConfig struct {
+	Windows []string `json:"windows"`
+	Mode    string   `json:"mode"`
+}
+
+// NotifyConfig configures the notifiers. Each setting stands in for the
+// flag named by the tags of its section and field, such as smtp-server, and
+// secrets such as passwords and chat URLs are given in the secrets section.
+type NotifyConfig struct {
+	Email    *EmailConfig    `json:"email" flag:"smtp"`
+	Webhook  *WebhookConfig  `json:"webhook" flag:"webhook"`
+	Slack    *ChatConfig     `json:"slack" flag:"slack"`
+	Teams    *ChatConfig     `json:"teams" flag:"teams"`
+	Incident *IncidentConfig `json:"incident" flag:"incident"`
+}
+
+type EmailConfig struct {
+	Server          string    `json:"server" flag:"server"`
+	Username        string    `json:"username" flag:"username"`
+	Source          string    `json:"source" flag:"source"`
+	Target          []string  `json:"target" flag:"target"`
+	Cc              []string  `json:"cc" flag:"cc"`
+	Auth            string    `json:"auth" flag:"auth"`
+	TLS             string    `json:"tls" flag:"tls"`
+	TLSSkipVerify   *bool     `json:"tlsSkipVerify" flag:"tls-skip-verify"`
+	Timeout         *Duration `json:"timeout" flag:"timeout"`
+	SubjectTemplate string    `json:"subjectTemplate" flag:"subject-template"`
+	TextTemplate    string    `json:"textTemplate" flag:"text-template"`
+	HTMLTemplate    string    `json:"htmlTemplate" flag:"html-template"`
+}
+
+type WebhookConfig struct {
+	URLs     []string  `json:"urls" flag:"urls"`
+	Timeout  *Duration `json:"timeout" flag:"timeout"`
+	Attempts *int      `json:"attempts" flag:"attempts"`
+}
+
+type ChatConfig struct {
+	Template string `json:"template" flag:"template"`
+}
+
+type IncidentConfig struct {
+	URL      string `json:"url" flag:"url"`
+	Severity string `json:"severity" flag:"severity"`
+}
+
+type ExecConfig struct {
+	Command string    `json:"command" flag:"command"`
+	Timeout *Duration `json:"timeout" flag:"timeout"`
+}
+
+// ActionConfig is the policy for an action, or for every action if it is
+// the default.
+type ActionConfig struct {
+	Timeout  *Duration `json:"timeout"`
+	Attempts *int      `json:"attempts"`
+}
+
+// actionDefault names the policy in the actions section that applies to
+// every action, in place of -action-timeout and -action-attempts.
+const actionDefault = "default"
+
+// configurableActions are the actions whose policies can be configured.
+var configurableActions = []string{actionDefault, actionRouteTable, actionExec, "email", "webhook", "slack", "teams", "incident", "manual-failover", "manual-failback"}
+
+// MonitorConfig describes a subnet to monitor. Anything left out is taken
+// from the defaults.
+type MonitorConfig struct {
+	Name      string       `json:"name"`
+	Subnet    string       `json:"subnet"`
+	Primary   string       `json:"primary"`
+	Secondary string       `json:"secondary"`
+	Probe     ProbeConfig  `json:"probe"`
+	Policy    PolicyConfig `json:"policy"`
+	Actions   []string     `json:"actions"`
+}
+
+type ProbeConfig struct {
+	Target   string   `json:"target"`
+	Timeout  Duration `json:"timeout"`
+	Interval Duration `json:"interval"`
+	History  int      `json:"history"`
+}
+
+// PolicyConfig decides when the probe results call for action.
+type PolicyConfig struct {
+	Threshold         int `json:"threshold"`
+	RecoveryThreshold int `json:"recoveryThreshold"`
+}
+
+// Actions a monitor can run, all of which run by default.
+const (
+	actionRouteTable = "routetable"
+	actionExec       = "exec"
+	actionNotify     = "notify"
+)
+
+var monitorActions = []string{actionRouteTable, actionExec, actionNotify}
+
+// inherit fills in anything left out of the monitor from d.
+func (m *MonitorConfig) inherit(d MonitorConfig) {
+	setString := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	setInt := func(v *int, def int) {
+		if *v == 0 {
+			*v = def
+		}
+	}
+	setDuration := func(v *Duration, def Duration) {
+		if *v == 0 {
+			*v = def
+		}
+	}
+	setString(&m.Name, d.Name)
+	setString(&m.Subnet, d.Subnet)
+	setString(&m.Primary, d.Primary)
+	setString(&m.Secondary, d.Secondary)
+	setString(&m.Probe.Target, d.Probe.Target)
+	setDuration(&m.Probe.Timeout, d.Probe.Timeout)
+	setDuration(&m.Probe.Interval, d.Probe.Interval)
+	setInt(&m.Probe.History, d.Probe.History)
+	setInt(&m.Policy.Threshold, d.Policy.Threshold)
+	setInt(&m.Policy.RecoveryThreshold, d.Policy.RecoveryThreshold)
+	if m.Actions == nil {
+		m.Actions = d.Actions
+	}
+}
+
+// flagMonitorConfig describes the monitor given by the flags and NAT_*
+// variables, with only those flags that were explicitly set if explicit is
+// true.
+func flagMonitorConfig(explicit bool) MonitorConfig {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	use := func(name string) bool { return !explicit || set[name] }
+
+	var m MonitorConfig
+	if use("name") {
+		m.Name = subnetName
+	}
+	if use("subnet") {
+		m.Subnet = subnetId
+	}
+	if use("primary") {
+		m.Primary = primaryRouteTableId
+	}
+	if use("secondary") {
+		m.Secondary = secondaryRouteTableId
+	}
+	if use("target") {
+		m.Probe.Target = checkTarget
+	}
+	if use("timeout") {
+		m.Probe.Timeout = Duration(checkTimeout)
+	}
+	if use("interval") {
+		m.Probe.Interval = Duration(checkInterval)
+	}
+	if use("history") {
+		m.Probe.History = checkHistorySize
+	}
+	if use("threshold") {
+		m.Policy.Threshold = checkFailureThreshold
+	}
+	if use("recovery-threshold") {
+		m.Policy.RecoveryThreshold = checkRecoveryThreshold
+	}
+	if !explicit {
+		m.Actions = monitorActions
+	}
+	return m
+}
+
+// loadConfig reads the configuration file, or describes the single monitor
+// given by the flags if there isn't one.
+func loadConfig() (*Config, error) {
+	if configFile == "" {
+		cfg := &Config{Monitors: []MonitorConfig{flagMonitorConfig(false)}}
+		return cfg, cfg.prepare()
+	}
+
+	b, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", configFile, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig decodes a configuration file, rejecting anything it doesn't
+// recognise, and fills in defaults.
+func parseConfig(b []byte) (*Config, error) {
+	var cfg Config
+	if err := strictUnmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// prepare applies the defaults to each monitor and validates the result.
+// Explicit flags take precedence over the file's defaults, which take
+// precedence over the flags' own defaults.
+func (cfg *Config) prepare() error {
+	defaults := flagMonitorConfig(true)
+	defaults.inherit(cfg.Defaults)
+	defaults.inherit(flagMonitorConfig(false))
+	// Names, subnets and route tables must be given for each monitor
+	if len(cfg.Monitors) > 1 {
+		defaults.Name, defaults.Subnet, defaults.Primary, defaults.Secondary = "", "", "", ""
+	}
+	for i := range cfg.Monitors {
+		cfg.Monitors[i].inherit(defaults)
+		if cfg.Monitors[i].Name == "" {
+			cfg.Monitors[i].Name = cfg.Monitors[i].Subnet
+		}
+	}
+	return cfg.validate()
+}
+
+// validate reports every problem with the configuration at once.
+func (cfg *Config) validate() error {
+	var errs []string
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if cfg.Budget != nil {
+		if cfg.Budget.Global != nil && *cfg.Budget.Global < 0 {
+			fail("budget.global", "must not be negative")
+		}
+		if cfg.Budget.Subnet != nil && *cfg.Budget.Subnet < 0 {
+			fail("budget.subnet", "must not be negative")
+		}
+		if cfg.Budget.Window != nil && *cfg.Budget.Window <= 0 {
+			fail("budget.window", "must be positive")
+		}
+	}
+	if cfg.Maintenance != nil {
+		if _, err := parseMaintenanceWindows(strings.Join(cfg.Maintenance.Windows, ";")); err != nil {
+			fail("maintenance.windows", "%v", err)
+		}
+		if mode := cfg.Maintenance.Mode; mode != "" && mode != silenceActions && mode != silenceAll {
+			fail("maintenance.mode", "must be %v or %v", silenceActions, silenceAll)
+		}
+	}
+
+	if cfg.Notify != nil && cfg.Notify.Webhook != nil {
+		w := cfg.Notify.Webhook
+		for i, u := range w.URLs {
+			if err := checkURL(u); err != nil {
+				fail(fmt.Sprintf("notify.webhook.urls[%v]", i), "%v", err)
+			}
+		}
+		if w.Timeout != nil && *w.Timeout <= 0 {
+			fail("notify.webhook.timeout", "must be positive")
+		}
+		if w.Attempts != nil && *w.Attempts < 1 {
+			fail("notify.webhook.attempts", "must be at least 1")
+		}
+	}
+	if cfg.Notify != nil && cfg.Notify.Email != nil && cfg.Notify.Email.Timeout != nil && *cfg.Notify.Email.Timeout <= 0 {
+		fail("notify.email.timeout", "must be positive")
+	}
+	if cfg.Exec != nil && cfg.Exec.Timeout != nil && *cfg.Exec.Timeout < 0 {
+		fail("exec.timeout", "must not be negative")
+	}
+	var actionNames []string
+	for name := range cfg.Actions {
+		actionNames = append(actionNames, name)
+	}
+	sort.Strings(actionNames)
+	for _, name := range actionNames {
+		a := cfg.Actions[name]
+		if !stringIn(name, configurableActions) {
+			fail("actions."+name, "unknown action, expected one of %v", strings.Join(configurableActions, ", "))
+		}
+		if a.Timeout != nil && *a.Timeout <= 0 {
+			fail("actions."+name+".timeout", "must be positive")
+		}
+		if a.Attempts != nil && *a.Attempts < 1 {
+			fail("actions."+name+".attempts", "must be at least 1")
+		}
+	}
+
+	var secretNames []string
+	for name := range cfg.Secrets {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+	for _, name := range secretNames {
+		if path := cfg.Secrets[name]; secrets[name] == nil {
+			fail("secrets."+name, "is not a secret setting")
+		} else if _, err := os.Stat(path); err != nil {
+			fail("secrets."+name, "%v", err)
+		}
+	}
+
+	if len(cfg.Monitors) == 0 {
+		fail("monitors", "at least one monitor is required")
+	}
+	names, subnets := map[string]bool{}, map[string]bool{}
+	for i, m := range cfg.Monitors {
+		path := fmt.Sprintf("monitors[%v]", i)
+		if m.Name != "" {
+			path = fmt.Sprintf("monitors[%v] (%v)", i, m.Name)
+		}
+		required := func(field, v string) {
+			if v == "" {
+				fail(path+"."+field, "is required")
+			}
+		}
+		required("subnet", m.Subnet)
+		required("primary", m.Primary)
+		required("secondary", m.Secondary)
+		required("probe.target", m.Probe.Target)
+
+		if names[m.Name] {
+			fail(path+".name", "%q is used by another monitor", m.Name)
+		}
+		names[m.Name] = true
+		if m.Subnet != "" && subnets[m.Subnet] {
+			fail(path+".subnet", "%v is watched by another monitor", m.Subnet)
+		}
+		subnets[m.Subnet] = true
+		if m.Primary != "" && m.Primary == m.Secondary {
+			fail(path+".secondary", "must differ from the primary route table")
+		}
+
+		if m.Probe.Timeout <= 0 {
+			fail(path+".probe.timeout", "must be positive")
+		}
+		if m.Probe.Interval <= 0 {
+			fail(path+".probe.interval", "must be positive")
+		}
+		if m.Probe.History < 0 {
+			fail(path+".probe.history", "must not be negative")
+		}
+		if m.Policy.Threshold < 1 {
+			fail(path+".policy.threshold", "must be at least 1")
+		}
+		if m.Policy.RecoveryThreshold < 1 {
+			fail(path+".policy.recoveryThreshold", "must be at least 1")
+		}
+		for _, action := range m.Actions {
+			if !stringIn(action, monitorActions) {
+				fail(path+".actions", "unknown action %q, expected one of %v", action, strings.Join(monitorActions, ", "))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// apply puts the global settings into effect. Flags given on the command
+// line take precedence. Dry run can only be changed at startup, as it is read
+// by actions that may be running.
+func (cfg *Config) apply(startup bool) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if cfg.DryRun != nil && !set["dry-run"] {
+		if startup {
+			dryRun = *cfg.DryRun
+		} else if *cfg.DryRun != dryRun {
+			glog.Warningf("Ignoring the change to dryRun, which requires a restart")
+		}
+	}
+
+	// Files for secrets are read from when they're next needed
+	for name, s := range secrets {
+		path := cfg.Secrets[name]
+		if set[name] || set[name+"-file"] {
+			path = ""
+		}
+		s.setConfigFile(path)
+	}
+	setEffectiveConfig(cfg)
+	settingsErr := cfg.applySettings(set)
+
+	global, subnet, window := budgetGlobal, budgetSubnet, budgetWindow
+	if b := cfg.Budget; b != nil {
+		if b.Global != nil && !set["budget-global"] {
+			global = *b.Global
+		}
+		if b.Subnet != nil && !set["budget-subnet"] {
+			subnet = *b.Subnet
+		}
+		if b.Window != nil && !set["budget-window"] {
+			window = time.Duration(*b.Window)
+		}
+	}
+	budget.SetLimits(global, subnet, window)
+
+	windows, mode := maintenanceWindows, maintenanceMode
+	if m := cfg.Maintenance; m != nil {
+		if !set["maintenance-windows"] {
+			windows = strings.Join(m.Windows, ";")
+		}
+		if m.Mode != "" && !set["maintenance-mode"] {
+			mode = m.Mode
+		}
+	}
+	if err := silences.Configure(windows, mode); err != nil {
+		return err
+	}
+	return settingsErr
+}
+
+var (
+	// settingsMu guards the settings a reload changes while actions run
+	settingsMu    sync.RWMutex
+	actionConfigs map[string]ActionConfig
+)
+
+// settingFlags are the flags that the notify, exec and actions sections
+// stand in for.
+var settingFlags = append(append(
+	sectionFlags("", reflect.TypeOf(NotifyConfig{})),
+	sectionFlags("exec", reflect.TypeOf(ExecConfig{}))...),
+	"action-timeout", "action-attempts")
+
+// applySettings sets the flags the file's settings stand in for. Those it
+// leaves out go back to their defaults, so that a reload can remove them.
+func (cfg *Config) applySettings(set map[string]bool) error {
+	values := map[string]string{}
+	sectionValues("", reflect.ValueOf(cfg.Notify), values)
+	sectionValues("exec", reflect.ValueOf(cfg.Exec), values)
+	if d, ok := cfg.Actions[actionDefault]; ok {
+		if d.Timeout != nil {
+			values["action-timeout"] = time.Duration(*d.Timeout).String()
+		}
+		if d.Attempts != nil {
+			values["action-attempts"] = strconv.Itoa(*d.Attempts)
+		}
+	}
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	var errs []string
+	for _, name := range settingFlags {
+		if set[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		v, ok := values[name]
+		if !ok {
+			v = f.DefValue
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		}
+	}
+	actionConfigs = cfg.Actions
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sectionFlags lists the flags named by the tags of a section's fields,
+// which are prefixed with the section's own.
+func sectionFlags(prefix string, t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := flagName(prefix, f.Tag.Get("flag"))
+		if f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct {
+			names = append(names, sectionFlags(name, f.Type.Elem())...)
+		} else {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sectionValues collects the settings given in a section as flag values.
+func sectionValues(prefix string, v reflect.Value, values map[string]string) {
+	if v.IsNil() {
+		return
+	}
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := flagName(prefix, v.Type().Field(i).Tag.Get("flag"))
+		switch f := v.Field(i); {
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+			sectionValues(name, f, values)
+		case f.Kind() == reflect.Ptr && !f.IsNil():
+			if d, ok := f.Elem().Interface().(Duration); ok {
+				values[name] = time.Duration(d).String()
+			} else {
+				values[name] = fmt.Sprint(f.Elem().Interface())
+			}
+		case f.Kind() == reflect.Slice && f.Len() > 0:
+			values[name] = strings.Join(f.Interface().([]string), ",")
+		case f.Kind() == reflect.String && f.String() != "":
+			values[name] = f.String()
+		}
+	}
+}
+
+func flagName(prefix, tag string) string {
+	if prefix == "" {
+		return tag
+	}
+	return prefix + "-" + tag
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// strictUnmarshal decodes JSON into v, rejecting fields that v doesn't have
+// so that typos are reported rather than silently ignored.
+func strictUnmarshal(b []byte, v interface{}) error {
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(b[:syntax.Offset], []byte("\n"))
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+		return err
+	}
+	if err := checkFields("", raw, reflect.TypeOf(v).Elem()); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return fmt.Errorf("expected %v, got %v", typeErr.Type, typeErr.Value)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkFields walks the decoded JSON alongside the type it will be decoded
+// into, returning the path of the first unknown field.
+func checkFields(path string, raw interface{}, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch val := raw.(type) {
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for key, item := range val {
+				if err := checkFields(join(path, key), item, t.Elem()); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		var known []string
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fields[strings.ToLower(name)] = t.Field(i).Type
+			known = append(known, name)
+		}
+		var keys []string
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ft, ok := fields[strings.ToLower(key)]
+			if !ok {
+				return fmt.Errorf("%vunknown field %q, expected one of %v", prefix(path), key, strings.Join(known, ", "))
+			}
+			if err := checkFields(join(path, key), val[key], ft); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, item := range val {
+			if err := checkFields(fmt.Sprintf("%v[%v]", path, i), item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func prefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{
+  "dryRun": false,
+  "budget": {"global": 6, "window": "2h"},
+  "defaults": {
+    "probe": {"target": "8.8.8.8", "timeout": "900ms"},
+    "policy": {"threshold": 10}
+  },
+  "monitors": [
+    {"name": "eu-west-1a", "subnet": "subnet-a", "primary": "rtb-a1", "secondary": "rtb-a2"},
+    {"subnet": "subnet-b", "primary": "rtb-b1", "secondary": "rtb-b2",
+     "probe": {"target": "8.8.4.4"}, "policy": {"threshold": 3}, "actions": ["notify"]}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Monitors) != 2 || *cfg.DryRun || *cfg.Budget.Global != 6 || time.Duration(*cfg.Budget.Window) != 2*time.Hour {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	a, b := cfg.Monitors[0], cfg.Monitors[1]
+	if a.Probe.Target != "8.8.8.8" || time.Duration(a.Probe.Timeout) != 900*time.Millisecond || a.Policy.Threshold != 10 {
+		t.Errorf("expected the defaults to apply, got %+v", a)
+	}
+	if time.Duration(a.Probe.Interval) != checkInterval || a.Policy.RecoveryThreshold != checkRecoveryThreshold {
+		t.Errorf("expected the flags to fill in the rest, got %+v", a)
+	}
+	if len(a.Actions) != len(monitorActions) {
+		t.Errorf("expected every action by default, got %v", a.Actions)
+	}
+	if b.Name != "subnet-b" || b.Probe.Target != "8.8.4.4" || b.Policy.Threshold != 3 || len(b.Actions) != 1 {
+		t.Errorf("expected the monitor's own settings to win, got %+v", b)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		errors []string
+	}{
+		{"{\n  \"monitors\": [\n}", []string{"line 3"}},
+		{`{"monitors": [{"subnet": "subnet-a", "probe": {"timout": "1s"}}]}`, []string{`monitors[0].probe: unknown field "timout"`}},
+		{`{"monitors": [{"subnet": "subnet-a", "probe": {"timeout": 1000}}]}`, []string{"durations should be strings"}},
+		{`{"monitors": []}`, []string{"at least one monitor"}},
+		{`{"monitors": [
+			{"name": "a", "subnet": "subnet-a", "primary": "rtb-1", "secondary": "rtb-1", "probe": {"target": "x"}},
+			{"name": "a", "subnet": "subnet-a", "probe": {"target": "x"}, "policy": {"threshold": -1}, "actions": ["reboot"]}
+		]}`, []string{
+			"monitors[0] (a).secondary: must differ",
+			"monitors[1] (a).primary: is required",
+			"monitors[1] (a).name: \"a\" is used by another monitor",
+			"monitors[1] (a).subnet: subnet-a is watched by another monitor",
+			"monitors[1] (a).policy.threshold: must be at least 1",
+			`monitors[1] (a).actions: unknown action "reboot"`,
+		}},
+		{`{"maintenance": {"mode": "some"}, "monitors": [{"subnet": "s", "primary": "p", "secondary": "q", "probe": {"target": "x"}}]}`, []string{"maintenance.mode"}},
+		{`{"notify": {"webhook": {"url": "http://x"}}, "monitors": []}`, []string{`notify.webhook: unknown field "url"`}},
+		{`{"actions": {"webhook": {"atempts": 2}}, "monitors": []}`, []string{`actions.webhook: unknown field "atempts"`}},
+		{`{"notify": {"webhook": {"urls": ["ftp://x"], "attempts": 0}}, "actions": {"reboot": {}, "exec": {"timeout": "0s"}}, "monitors": [{"subnet": "s", "primary": "p", "secondary": "q", "probe": {"target": "x"}}]}`, []string{
+			"notify.webhook.urls[0]: expected an http or https URL",
+			"notify.webhook.attempts: must be at least 1",
+			"actions.exec.timeout: must be positive",
+			"actions.reboot: unknown action",
+		}},
+	} {
+		_, err := parseConfig([]byte(tc.config))
+		if err == nil {
+			t.Errorf("expected %q to be rejected", tc.config)
+			continue
+		}
+		for _, want := range tc.errors {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("expected the error for %q to mention %q, got %v", tc.config, want, err)
+			}
+		}
+	}
+}
+
+func TestConfigNotifierSettings(t *testing.T) {
+	oldBudget := budget
+	budget = newFailoverBudget()
+	defer func() {
+		budget = oldBudget
+		(&Config{}).applySettings(nil)
+	}()
+
+	load := func(settings string) {
+		cfg, err := parseConfig([]byte(`{` + settings + `"monitors": [{"subnet": "s", "primary": "p", "secondary": "q", "probe": {"target": "x"}}]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.apply(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load(`"notify": {"webhook": {"urls": ["http://a", "http://b"], "attempts": 5}, "email": {"server": "localhost:25", "auth": "none", "source": "nat@example.com", "target": ["a@example.com", "b@example.com"], "tlsSkipVerify": true}},
+		"exec": {"command": "true", "timeout": "5s"},
+		"actions": {"default": {"attempts": 2}, "webhook": {"timeout": "3s"}},`)
+	if webhookURLs != "http://a,http://b" || webhookAttempts != 5 || smtpTarget != "a@example.com,b@example.com" || !smtpTLSSkipVerify {
+		t.Errorf("unexpected notifier settings %q %v %q %v", webhookURLs, webhookAttempts, smtpTarget, smtpTLSSkipVerify)
+	}
+	if execCommand != "true" || execTimeout != 5*time.Second {
+		t.Errorf("unexpected exec settings %q %v", execCommand, execTimeout)
+	}
+	if p := policyFor("exec"); p.retry.attempts != 2 || p.timeout != actionTimeout {
+		t.Errorf("expected the default action policy, got %+v", p)
+	}
+	if p := policyFor("webhook"); p.retry.attempts != 2 || p.timeout != 3*time.Second {
+		t.Errorf("expected the webhook's own policy, got %+v", p)
+	}
+
+	n := newNotifiers()
+	if err := n.configure(); err != nil {
+		t.Fatal(err)
+	}
+	sub := n.channels["webhook"]
+	if sub == nil || n.channels["email"] == nil || len(n.fanout.actions) != 2 {
+		t.Fatalf("expected the email and webhook to be configured, got %+v", n.fanout.actions)
+	}
+
+	load(`"notify": {"webhook": {"urls": ["http://c"]}},`)
+	if err := n.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if n.channels["webhook"] != sub || n.fanout.actions["webhook"] != sub {
+		t.Errorf("expected the webhook to keep its subscription")
+	}
+	if _, ok := n.fanout.actions["email"]; ok {
+		t.Errorf("expected the email to be removed")
+	}
+	if w := sub.action.(*throttle).action.(*webhookAction); len(w.urls) != 1 || w.urls[0] != "http://c" {
+		t.Errorf("expected the webhook to use the new URL, got %v", w.urls)
+	}
+
+	// Settings removed from the file go back to the flags
+	load("")
+	if webhookURLs != "" || webhookAttempts != 3 || execCommand != "" || actionAttempts != 1 || policyFor("webhook").timeout != actionTimeout {
+		t.Errorf("expected the flag defaults, got %q %v %q %v", webhookURLs, webhookAttempts, execCommand, actionAttempts)
+	}
+	if err := n.configure(); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.fanout.actions) != 0 {
+		t.Errorf("expected no notifiers, got %+v", n.fanout.actions)
+	}
+}
@@ -7,6 +7,4 @@ AZ=`curl -s http://169.254.169.254/latest/meta-data/placement/availability-zone`
 . /secrets.env
 . /${AZ}.env
 
-env 1>&2
-
-./nat-my-idea-of-a-good-time -logtostderr -name ${AZ}
+./nat-my-idea-of-a-good-time -logtostderr
@@ -1,68 +1,467 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/pkg/errors"
 )
 
 var (
-	smtpServer   string
-	smtpUsername string
-	smtpPassword string
-	smtpSource   string
-	smtpTarget   string
+	smtpServer          string
+	smtpUsername        string
+	smtpPassword        secret
+	smtpSource          string
+	smtpTarget          string
+	smtpCc              string
+	smtpAuth            string
+	smtpTLS             string
+	smtpTLSSkipVerify   bool
+	smtpTimeout         time.Duration
+	smtpSubjectTemplate string
+	smtpTextTemplate    string
+	smtpHTMLTemplate    string
 )
 
 func init() {
 	flag.StringVar(&smtpServer, "smtp-server", getEnv("NAT_SMTP_SERVER", ""), "SMTP server use for alert sending")
 	flag.StringVar(&smtpUsername, "smtp-username", getEnv("NAT_SMTP_USERNAME", ""), "SMTP server username")
-	flag.StringVar(&smtpPassword, "smtp-password", getEnv("NAT_SMTP_PASSWORD", ""), "SMTP server password")
+	secretVar(&smtpPassword, "smtp-password", "NAT_SMTP_PASSWORD", "SMTP server password")
 	flag.StringVar(&smtpSource, "smtp-source", getEnv("NAT_SMTP_SOURCE", ""), "Email address to send alerts as")
-	flag.StringVar(&smtpTarget, "smtp-target", getEnv("NAT_SMTP_TARGET", ""), "Email address to send alerts to")
+	flag.StringVar(&smtpTarget, "smtp-target", getEnv("NAT_SMTP_TARGET", ""), "Comma separated email addresses to send alerts to")
+	flag.StringVar(&smtpCc, "smtp-cc", getEnv("NAT_SMTP_CC", ""), "Comma separated email addresses to copy alerts to")
+	flag.StringVar(&smtpAuth, "smtp-auth", getEnv("NAT_SMTP_AUTH", "cram-md5"), "SMTP authentication mechanism: cram-md5, plain, login or none")
+	flag.StringVar(&smtpTLS, "smtp-tls", getEnv("NAT_SMTP_TLS", "auto"), "SMTP TLS mode: auto (STARTTLS if offered), starttls (required), implicit (e.g. port 465) or none")
+	flag.BoolVar(&smtpTLSSkipVerify, "smtp-tls-skip-verify", getEnvBool("NAT_SMTP_TLS_SKIP_VERIFY", false), "Don't verify the SMTP server's certificate")
+	flag.DurationVar(&smtpTimeout, "smtp-timeout", getEnvMs("NAT_SMTP_TIMEOUT_MS", 10000), "Timeout for sending an email in milliseconds")
+	flag.StringVar(&smtpSubjectTemplate, "smtp-subject-template", getEnv("NAT_SMTP_SUBJECT_TEMPLATE", ""), "File containing a template for the email subject")
+	flag.StringVar(&smtpTextTemplate, "smtp-text-template", getEnv("NAT_SMTP_TEXT_TEMPLATE", ""), "File containing a template for the plain text email body")
+	flag.StringVar(&smtpHTMLTemplate, "smtp-html-template", getEnv("NAT_SMTP_HTML_TEMPLATE", ""), "File containing a template for the HTML email body")
 }
 
-func makeEmailAction() Action {
-	if smtpServer+smtpUsername+smtpPassword+smtpSource+smtpTarget == "" {
+const defaultEmailSubject = `{{.Title}}`
+
+const defaultEmailText = `
+{{- if or (eq .Lifecycle "recovered") (eq .Lifecycle "failed-back") -}}
+YOUR NAT IN {{.Monitor}} IS WORKING AGAIN, after failing for {{.FailingFor}}.
+
+The subnet is using route table {{.CurrentRouteTable}}.
+{{- else if eq .Lifecycle "digest" -}}
+I held back {{len .Suppressed}} notifications about your NAT in {{.Monitor}}:
+{{.SuppressedText}}
+{{- else if or (eq .Lifecycle "degraded") (eq .Lifecycle "drift-detected") -}}
+Something's up with your NAT in {{.Monitor}}: {{.Lifecycle}}.
+
+The last check error was {{.LastError}}
+The subnet is using route table {{.CurrentRouteTable}}, and I expected {{.TargetRouteTable}}.
+{{- else -}}
+HEY YOUR NAT'S BROKEN IN {{.Monitor}}!
+
+My health check of {{.Target}} failed {{.ConsecutiveFailures}} times in a row over {{.FailingFor}}, with the error {{.LastError}}
+
+In the last {{.Window.Checks}} checks {{.Window.Failures}} failed. Latency min/mean/max was {{.Window.MinLatency}}/{{.Window.MeanLatency}}/{{.Window.MaxLatency}}.
+
+I tried to move the subnet from route table {{.CurrentRouteTable}} to {{.TargetRouteTable}}. Here's how that went:
+{{.ResultsText}}
+{{- end}}
+{{if .StatusURL}}
+Status: {{.StatusURL}}
+Metrics: {{.MetricsURL}}
+{{end}}
+Yours, always,
+
+The NAT King
+`
+
+const defaultEmailHTML = `<html>
+<body>
+<h2 style="color: #{{.Color}}">{{.Title}}</h2>
+{{- if .Suppressed}}
+<p>I held back these notifications:</p>
+<ul>
+{{- range .Suppressed}}
+<li>{{.Time}} {{.Subnet}} {{.Kind}} ({{.Reason}}){{if .LastError}}: {{.LastError}}{{end}}</li>
+{{- end}}
+</ul>
+{{- else}}
+<table>
+<tr><th align="left">Monitor</th><td>{{.Monitor}}</td></tr>
+<tr><th align="left">Subnet</th><td>{{.Subnet}}</td></tr>
+<tr><th align="left">Target</th><td>{{.Target}}</td></tr>
+<tr><th align="left">Failures</th><td>{{.ConsecutiveFailures}} consecutive over {{.FailingFor}}, {{.Window.Failures}} of the last {{.Window.Checks}} checks</td></tr>
+<tr><th align="left">Latency</th><td>{{.Window.MinLatency}} / {{.Window.MeanLatency}} / {{.Window.MaxLatency}}</td></tr>
+<tr><th align="left">Last error</th><td>{{.LastError}}</td></tr>
+<tr><th align="left">Route table</th><td>{{.CurrentRouteTable}} (expected {{.TargetRouteTable}})</td></tr>
+</table>
+{{- end}}
+{{- if .Results}}
+<h3>Actions</h3>
+<ul>
+{{- range .Results}}
+<li>{{.Action}}: {{.Status}}{{if .Error}} ({{.Error}}){{end}}
+{{- with .Details.plan}}<br>Dry run, so nothing was changed. The plan was to:<pre>{{.}}</pre>{{end}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .StatusURL}}
+<p><a href="{{.StatusURL}}">Status</a> | <a href="{{.MetricsURL}}">Metrics</a></p>
+{{- end}}
+<p>Yours, always,<br>The NAT King</p>
+</body>
+</html>
+`
+
+// emailAction renders notifications from templates and sends them as
+// multipart plain text and HTML messages.
+type emailAction struct {
+	server  string
+	host    string
+	from    *mail.Address
+	to      []*mail.Address
+	cc      []*mail.Address
+	auth    func() smtp.Auth // made for each message, as the password may change
+	tlsMode string
+	tls     *tls.Config
+	timeout time.Duration
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+func makeEmailAction() (Action, error) {
+	if smtpServer+smtpUsername+smtpPassword.Get()+smtpSource+smtpTarget == "" {
 		glog.Infof("Skipping email action due to absent configuration")
-		return nil
+		return nil, nil
+	}
+
+	e, err := newEmailAction()
+	if err != nil {
+		return nil, errors.Wrap(err, "email configuration invalid")
+	}
+	return e, nil
+}
+
+func newEmailAction() (*emailAction, error) {
+	if smtpServer == "" || smtpSource == "" || smtpTarget == "" {
+		return nil, errors.New("server, source and target are required")
+	}
+	host, _, err := net.SplitHostPort(smtpServer)
+	if err != nil {
+		return nil, errors.Wrap(err, "server must be host:port")
+	}
+
+	e := &emailAction{
+		server:  smtpServer,
+		host:    host,
+		tlsMode: smtpTLS,
+		tls:     &tls.Config{ServerName: host, InsecureSkipVerify: smtpTLSSkipVerify},
+		timeout: smtpTimeout,
+	}
+	switch smtpTLS {
+	case "auto", "starttls", "implicit", "none":
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q", smtpTLS)
 	}
 
-	if smtpServer == "" ||
-		smtpUsername == "" ||
-		smtpPassword == "" ||
-		smtpSource == "" ||
-		smtpTarget == "" {
-		glog.Fatalln("Email configuration incomplete")
+	if e.from, err = mail.ParseAddress(smtpSource); err != nil {
+		return nil, errors.Wrap(err, "invalid source address")
+	}
+	if e.to, err = parseAddressList(smtpTarget); err != nil {
+		return nil, errors.Wrap(err, "invalid target address")
+	}
+	if e.cc, err = parseAddressList(smtpCc); err != nil {
+		return nil, errors.Wrap(err, "invalid cc address")
 	}
 
-	return makeAction(sendEmail)
+	if smtpAuth != "none" && (smtpUsername == "" || smtpPassword.Get() == "") {
+		return nil, fmt.Errorf("username and password are required for %v authentication", smtpAuth)
+	}
+	username, password := smtpUsername, &smtpPassword
+	switch smtpAuth {
+	case "cram-md5":
+		e.auth = func() smtp.Auth { return smtp.CRAMMD5Auth(username, password.Get()) }
+	case "plain":
+		e.auth = func() smtp.Auth { return smtp.PlainAuth("", username, password.Get(), host) }
+	case "login":
+		e.auth = func() smtp.Auth { return &loginAuth{username: username, password: password.Get(), host: host} }
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown authentication mechanism %q", smtpAuth)
+	}
+
+	text, err := readTemplate("subject", smtpSubjectTemplate, defaultEmailSubject)
+	if err == nil {
+		e.subject, err = template.New("subject").Parse(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	text, err = readTemplate("text", smtpTextTemplate, defaultEmailText)
+	if err == nil {
+		e.text, err = template.New("text").Parse(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	text, err = readTemplate("HTML", smtpHTMLTemplate, defaultEmailHTML)
+	if err == nil {
+		e.html, err = htmltemplate.New("html").Parse(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
 }
 
-func sendEmail(checkError error) error {
+// readTemplate returns the contents of file, or def if no file was given.
+func readTemplate(kind, file, def string) (string, error) {
+	if file == "" {
+		return def, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading %v template failed", kind)
+	}
+	return string(b), nil
+}
+
+func parseAddressList(s string) ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, item := range splitList(s) {
+		addr, err := mail.ParseAddress(item)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (e *emailAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
 	glog.Infoln("Sending alert email")
 
-	msg := []byte(fmt.Sprintf(`From: %v
-To: %v
-Subject: %v NAT FAILURE
+	msg, err := e.render(ev, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-HEY YOUR NAT'S BROKEN IN %v! I FAILED IT OVER FOR YOU (HOPEFULLY)
+	res := Result{"to": joinAddresses(e.to)}
+	if len(e.cc) > 0 {
+		res["cc"] = joinAddresses(e.cc)
+	}
+	if dryRun {
+		glog.Infof("Would be sending email: %s", msg)
+		return res, nil
+	}
+	return res, e.send(ctx, msg)
+}
 
-My health check failed with the error %v
+// render builds a multipart/alternative message with plain text and HTML
+// bodies.
+func (e *emailAction) render(ev *Event, now time.Time) ([]byte, error) {
+	data := newNotification(ev)
 
-Yours, always,
+	var subject, text, html bytes.Buffer
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return nil, errors.Wrap(err, "rendering email subject failed")
+	}
+	if err := e.text.Execute(&text, data); err != nil {
+		return nil, errors.Wrap(err, "rendering email text failed")
+	}
+	if err := e.html.Execute(&html, data); err != nil {
+		return nil, errors.Wrap(err, "rendering email HTML failed")
+	}
 
-The NAT King
-`, subnetName, subnetName, smtpTarget, smtpSource, checkError))
+	var msg, body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		qp.Write(part.content)
+		qp.Close()
+	}
+	parts.Close()
+
+	headers := []struct{ name, value string }{
+		{"From", e.from.String()},
+		{"To", joinAddresses(e.to)},
+		{"Cc", joinAddresses(e.cc)},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String()))},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", messageID(e.from.Address, now)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, h := range headers {
+		if h.value != "" {
+			fmt.Fprintf(&msg, "%v: %v\r\n", h.name, h.value)
+		}
+	}
+	msg.WriteString("\r\n")
+	body.WriteTo(&msg)
+
+	return msg.Bytes(), nil
+}
 
+func joinAddresses(addrs []*mail.Address) string {
+	var s []string
+	for _, addr := range addrs {
+		s = append(s, addr.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// messageID generates a unique Message-ID in the sender's domain.
+func messageID(from string, now time.Time) string {
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	return fmt.Sprintf("<%d.%x@%v>", now.UnixNano(), rand.Int63(), domain)
+}
+
+// send delivers the message to every recipient, using TLS according to the
+// configured mode.
+func (e *emailAction) send(ctx context.Context, msg []byte) error {
+	deadline := time.Now().Add(e.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
 	var err error
-	if dryRun {
-		glog.Infof("Would be sending email: %v", string(msg))
+	if e.tlsMode == "implicit" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.server, e.tls)
 	} else {
-		err = smtp.SendMail(smtpServer, smtp.CRAMMD5Auth(smtpUsername, smtpPassword), smtpSource, []string{smtpTarget}, msg)
+		conn, err = dialer.Dial("tcp", e.server)
+	}
+	if err != nil {
+		return errors.Wrap(err, "connecting to SMTP server failed")
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if e.tlsMode == "auto" || e.tlsMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(e.tls); err != nil {
+				return errors.Wrap(err, "STARTTLS failed")
+			}
+		} else if e.tlsMode == "starttls" {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+	}
+
+	if e.auth != nil {
+		if err := c.Auth(e.auth()); err != nil {
+			return errors.Wrap(err, "SMTP authentication failed")
+		}
+	}
+
+	if err := c.Mail(e.from.Address); err != nil {
+		return err
+	}
+	for _, addr := range append(append([]*mail.Address(nil), e.to...), e.cc...) {
+		if err := c.Rcpt(addr.Address); err != nil {
+			return errors.Wrapf(err, "recipient %v rejected", addr.Address)
+		}
 	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// loginAuth implements the LOGIN mechanism, which net/smtp doesn't provide.
+// Like smtp.PlainAuth it only sends credentials over TLS or to localhost.
+type loginAuth struct {
+	username, password, host string
+}
 
-	return err
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+func formatResults(results []ActionResult) string {
+	if len(results) == 0 {
+		return "  (no actions ran)\n"
+	}
+
+	var buf bytes.Buffer
+	for _, r := range results {
+		fmt.Fprintf(&buf, "  %v: %v", r.Action, r.Status)
+		if r.Error != "" {
+			fmt.Fprintf(&buf, " (%v)", r.Error)
+		}
+		buf.WriteString("\n")
+		if plan := r.Details["plan"]; plan != "" {
+			buf.WriteString("    Dry run, so nothing was changed. The plan was to:\n")
+			for _, step := range strings.Split(plan, "\n") {
+				fmt.Fprintf(&buf, "    - %v\n", step)
+			}
+		}
+	}
+	return buf.String()
 }
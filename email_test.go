@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a minimal SMTP server accepting a single session, recording
+// what the client sent.
+type fakeSMTP struct {
+	ln       net.Listener
+	tls      *tls.Config
+	implicit bool
+	done     chan struct{}
+
+	mu          sync.Mutex
+	usedTLS     bool
+	credentials []string
+	from        string
+	rcpts       []string
+	data        string
+}
+
+func newFakeSMTP(t *testing.T, cert *tls.Certificate, implicit bool) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, implicit: implicit, done: make(chan struct{})}
+	if cert != nil {
+		s.tls = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTP) close() {
+	s.ln.Close()
+	<-s.done
+}
+
+func (s *fakeSMTP) serve() {
+	defer close(s.done)
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer func() { conn.Close() }()
+	if s.implicit {
+		conn = tls.Server(conn, s.tls)
+		s.usedTLS = true
+	}
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO":
+			tp.PrintfLine("250-localhost")
+			if s.tls != nil && !s.usedTLS {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN")
+		case verb == "STARTTLS":
+			tp.PrintfLine("220 Ready to start TLS")
+			conn = tls.Server(conn, s.tls)
+			tp = textproto.NewConn(conn)
+			s.usedTLS = true
+		case strings.HasPrefix(line, "AUTH PLAIN "):
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, "AUTH PLAIN "))
+			s.addCredentials(strings.Replace(strings.TrimPrefix(string(b), "\x00"), "\x00", ":", 1))
+			tp.PrintfLine("235 Authenticated")
+		case line == "AUTH LOGIN":
+			var creds []string
+			for _, prompt := range []string{"Username:", "Password:"} {
+				tp.PrintfLine("334 %v", base64.StdEncoding.EncodeToString([]byte(prompt)))
+				reply, _ := tp.ReadLine()
+				b, _ := base64.StdEncoding.DecodeString(reply)
+				creds = append(creds, string(b))
+			}
+			s.addCredentials(strings.Join(creds, ":"))
+			tp.PrintfLine("235 Authenticated")
+		case verb == "MAIL":
+			s.mu.Lock()
+			s.from = line
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case verb == "RCPT":
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, line)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case verb == "DATA":
+			tp.PrintfLine("354 Go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.data = string(b)
+			s.mu.Unlock()
+			tp.PrintfLine("250 Queued")
+		case verb == "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTP) addCredentials(c string) {
+	s.mu.Lock()
+	s.credentials = append(s.credentials, c)
+	s.mu.Unlock()
+}
+
+// testCertificate borrows the self-signed certificate httptest uses, which is
+// valid for 127.0.0.1.
+func testCertificate(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	cert := srv.TLS.Certificates[0]
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return &cert, pool
+}
+
+// withEmailConfig sets the email flags, returning a function that restores
+// them.
+func withEmailConfig(server, tlsMode, auth string) func() {
+	old := []string{smtpServer, smtpUsername, smtpPassword.value, smtpSource, smtpTarget, smtpCc, smtpAuth, smtpTLS}
+	oldDryRun := dryRun
+	restore := func() {
+		smtpServer, smtpUsername, smtpPassword.value, smtpSource, smtpTarget, smtpCc, smtpAuth, smtpTLS = old[0], old[1], old[2], old[3], old[4], old[5], old[6], old[7]
+		dryRun = oldDryRun
+	}
+
+	smtpServer = server
+	smtpUsername = "nat"
+	smtpPassword.value = "secret"
+	smtpSource = "NAT King <nat@example.com>"
+	smtpTarget = "ops@example.com, Oncall <oncall@example.com>"
+	smtpCc = "boss@example.com"
+	smtpAuth = auth
+	smtpTLS = tlsMode
+	dryRun = false
+	return restore
+}
+
+func TestEmailRender(t *testing.T) {
+	defer withEmailConfig("127.0.0.1:25", "none", "none")()
+	e, err := newEmailAction()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg, err := e.render(testEvent(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if to, err := m.Header.AddressList("To"); err != nil || len(to) != 2 {
+		t.Errorf("unexpected To %q: %v", m.Header.Get("To"), err)
+	}
+	if m.Header.Get("Cc") != "<boss@example.com>" {
+		t.Errorf("unexpected Cc %q", m.Header.Get("Cc"))
+	}
+	if date, err := m.Header.Date(); err != nil || !date.Equal(now) {
+		t.Errorf("unexpected Date %q: %v", m.Header.Get("Date"), err)
+	}
+	if id := m.Header.Get("Message-Id"); !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("unexpected Message-ID %q", id)
+	}
+	if subject := m.Header.Get("Subject"); subject != "eu-west-1a NAT failover FAILED" {
+		t.Errorf("unexpected Subject %q", subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected Content-Type %q: %v", m.Header.Get("Content-Type"), err)
+	}
+	parts := multipart.NewReader(m.Body, params["boundary"])
+	for _, want := range []struct{ contentType, text string }{
+		{"text/plain; charset=utf-8", "routetable: error (throttled)"},
+		{"text/html; charset=utf-8", "&#34;quoted&#34;"},
+	} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if ct := part.Header.Get("Content-Type"); ct != want.contentType {
+			t.Errorf("unexpected part type %q", ct)
+		}
+		if !strings.Contains(string(body), want.text) {
+			t.Errorf("%v part doesn't contain %q:\n%s", want.contentType, want.text, body)
+		}
+	}
+}
+
+func TestEmailSend(t *testing.T) {
+	cert, pool := testCertificate(t)
+
+	for _, tc := range []struct {
+		tlsMode string
+		auth    string
+		useTLS  bool
+	}{
+		{"none", "plain", false},
+		{"auto", "login", true},
+		{"starttls", "plain", true},
+		{"implicit", "login", true},
+	} {
+		t.Run(tc.tlsMode+"/"+tc.auth, func(t *testing.T) {
+			var srvCert *tls.Certificate
+			if tc.useTLS {
+				srvCert = cert
+			}
+			srv := newFakeSMTP(t, srvCert, tc.tlsMode == "implicit")
+			defer srv.close()
+			defer withEmailConfig(srv.ln.Addr().String(), tc.tlsMode, tc.auth)()
+
+			e, err := newEmailAction()
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.tls.RootCAs = pool
+
+			res, err := e.Trigger(context.Background(), testEvent())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res["cc"] != "<boss@example.com>" {
+				t.Errorf("unexpected result %v", res)
+			}
+			srv.close()
+
+			if srv.usedTLS != tc.useTLS {
+				t.Errorf("expected TLS %v, got %v", tc.useTLS, srv.usedTLS)
+			}
+			if len(srv.credentials) != 1 || srv.credentials[0] != "nat:secret" {
+				t.Errorf("unexpected credentials %q", srv.credentials)
+			}
+			if srv.from != "MAIL FROM:<nat@example.com>" {
+				t.Errorf("unexpected sender %q", srv.from)
+			}
+			if len(srv.rcpts) != 3 {
+				t.Errorf("expected 3 recipients, got %q", srv.rcpts)
+			}
+			if !strings.Contains(srv.data, "HEY YOUR NAT'S BROKEN IN eu-west-1a!") {
+				t.Errorf("unexpected message:\n%v", srv.data)
+			}
+		})
+	}
+}
+
+func TestEmailStartTLSRequired(t *testing.T) {
+	srv := newFakeSMTP(t, nil, false)
+	defer srv.close()
+	defer withEmailConfig(srv.ln.Addr().String(), "starttls", "plain")()
+
+	e, err := newEmailAction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Trigger(context.Background(), testEvent()); err == nil {
+		t.Fatal("expected an error without STARTTLS support")
+	}
+}
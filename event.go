@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	stateHealthy  = "healthy"
+	stateDegraded = "degraded"
+	stateFailed   = "failed"
+)
+
+// Lifecycle event kinds, which notifiers can subscribe to.
+const (
+	eventDegraded       = "degraded"
+	eventFailed         = "failed"
+	eventFailedOver     = "failed-over"
+	eventFailoverFailed = "failover-failed"
+	eventRecovered      = "recovered"
+	eventFailedBack     = "failed-back"
+	eventDrift          = "drift-detected"
+)
+
+// eventDigest summarises notifications that were suppressed. It is sent by
+// the notification throttle rather than subscribed to.
+const eventDigest = "digest"
+
+var lifecycleEvents = []string{
+	eventDegraded,
+	eventFailed,
+	eventFailedOver,
+	eventFailoverFailed,
+	eventRecovered,
+	eventFailedBack,
+	eventDrift,
+}
+
+// ProbeResult is the outcome of a single health check.
+type ProbeResult struct {
+	Time    time.Time     `json:"time"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// WindowStats summarises the probe results held in the history window.
+type WindowStats struct {
+	Checks      int           `json:"checks"`
+	Failures    int           `json:"failures"`
+	MinLatency  time.Duration `json:"minLatency"`
+	MeanLatency time.Duration `json:"meanLatency"`
+	MaxLatency  time.Duration `json:"maxLatency"`
+}
+
+// Result carries structured output from an action, such as the route table
+// that was associated, so that it can be reported further down the line.
+type Result map[string]string
+
+// ActionResult records how an action responded to an event.
+type ActionResult struct {
+	Action   string        `json:"action"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Details  Result        `json:"details,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// SuppressedEvent records a notification that was held back, to be
+// reported in a digest.
+type SuppressedEvent struct {
+	Kind      string    `json:"kind"`
+	Monitor   string    `json:"monitor"`
+	Subnet    string    `json:"subnet"`
+	Time      time.Time `json:"time"`
+	LastError string    `json:"lastError,omitempty"`
+	Reason    string    `json:"reason"`
+}
+
+// Event describes a monitor state transition and everything we know about
+// the checks that caused it.
+type Event struct {
+	Kind    string    `json:"kind"`
+	Monitor string    `json:"monitor"`
+	Subnet  string    `json:"subnet"`
+	Target  string    `json:"target"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Time    time.Time `json:"time"`
+
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	FirstFailure        time.Time     `json:"firstFailure"`
+	LastError           string        `json:"lastError,omitempty"`
+	Window              WindowStats   `json:"window"`
+	Probes              []ProbeResult `json:"probes"`
+
+	CurrentRouteTable string `json:"currentRouteTable"`
+	TargetRouteTable  string `json:"targetRouteTable"`
+
+	Suppressed []SuppressedEvent `json:"suppressed,omitempty"`
+
+	mu      sync.Mutex
+	results []ActionResult
+}
+
+// Lifecycle returns the kind of the event. Failures are refined by the
+// outcome of the route table stage once it has run.
+func (ev *Event) Lifecycle() string {
+	if ev.Kind != eventFailed {
+		return ev.Kind
+	}
+
+	r, ok := ev.Result("routetable")
+	switch {
+	case !ok || r.Status == resultSkipped:
+		return eventFailed
+	case r.Status == resultSuccess:
+		return eventFailedOver
+	default:
+		return eventFailoverFailed
+	}
+}
+
+// FailingFor returns how long the checks have been failing.
+func (ev *Event) FailingFor() time.Duration {
+	if ev.FirstFailure.IsZero() {
+		return 0
+	}
+	return ev.Time.Sub(ev.FirstFailure)
+}
+
+// AddResult records the outcome of an action against the event.
+func (ev *Event) AddResult(r ActionResult) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.results = append(ev.results, r)
+}
+
+// Result returns the outcome of the named action, if it has completed.
+func (ev *Event) Result(action string) (ActionResult, bool) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	for i := len(ev.results) - 1; i >= 0; i-- {
+		if ev.results[i].Action == action {
+			return ev.results[i], true
+		}
+	}
+	return ActionResult{}, false
+}
+
+// Results returns the outcomes of the actions that have completed so far.
+func (ev *Event) Results() []ActionResult {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return append([]ActionResult(nil), ev.results...)
+}
+
+// probeHistory is a fixed size window of the most recent probe results.
+type probeHistory struct {
+	size    int
+	results []ProbeResult
+}
+
+func newProbeHistory(size int) *probeHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &probeHistory{size: size}
+}
+
+func (h *probeHistory) Add(r ProbeResult) {
+	h.results = append(h.results, r)
+	if len(h.results) > h.size {
+		h.results = h.results[len(h.results)-h.size:]
+	}
+}
+
+func (h *probeHistory) Recent() []ProbeResult {
+	return append([]ProbeResult(nil), h.results...)
+}
+
+func (h *probeHistory) Stats() WindowStats {
+	var s WindowStats
+	var total time.Duration
+	for i, r := range h.results {
+		s.Checks++
+		if r.Error != "" {
+			s.Failures++
+		}
+		total += r.Latency
+		if i == 0 || r.Latency < s.MinLatency {
+			s.MinLatency = r.Latency
+		}
+		if r.Latency > s.MaxLatency {
+			s.MaxLatency = r.Latency
+		}
+	}
+	if s.Checks > 0 {
+		s.MeanLatency = total / time.Duration(s.Checks)
+	}
+	return s
+}
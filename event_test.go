@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeHistoryWindow(t *testing.T) {
+	h := newProbeHistory(3)
+	h.Add(ProbeResult{Latency: 100 * time.Millisecond})
+	h.Add(ProbeResult{Latency: 10 * time.Millisecond, Error: "timeout"})
+	h.Add(ProbeResult{Latency: 20 * time.Millisecond})
+	h.Add(ProbeResult{Latency: 30 * time.Millisecond, Error: "timeout"})
+
+	if n := len(h.Recent()); n != 3 {
+		t.Fatalf("expected the window to hold 3 results, got %v", n)
+	}
+
+	s := h.Stats()
+	want := WindowStats{
+		Checks:      3,
+		Failures:    2,
+		MinLatency:  10 * time.Millisecond,
+		MeanLatency: 20 * time.Millisecond,
+		MaxLatency:  30 * time.Millisecond,
+	}
+	if s != want {
+		t.Errorf("expected %+v, got %+v", want, s)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	execCommand string
+	execTimeout time.Duration
+)
+
+func init() {
+	flag.StringVar(&execCommand, "exec-command", getEnv("NAT_EXEC_COMMAND", ""), "Command, with space separated arguments, to run on failover with the event as JSON on stdin")
+	flag.DurationVar(&execTimeout, "exec-timeout", getEnvMs("NAT_EXEC_TIMEOUT_MS", 30000), "Time after which the exec command is killed in milliseconds")
+}
+
+// execAction runs a site-specific command. The command receives the same
+// JSON document as webhooks on stdin, and the main fields of the event as
+// NAT_EVENT_* environment variables. Secrets are left out of its environment.
+type execAction struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+func makeExecAction() (*execAction, error) {
+	fields := strings.Fields(execCommand)
+	if len(fields) == 0 {
+		glog.Infof("Skipping exec action due to absent configuration")
+		return nil, nil
+	}
+
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "exec command not found")
+	}
+	return &execAction{path: path, args: fields[1:], timeout: execTimeout}, nil
+}
+
+func (a *execAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	input, err := json.Marshal(newWebhookPayload(ev))
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding exec input failed")
+	}
+
+	if dryRun {
+		glog.Infof("Would be running %v %v", a.path, strings.Join(a.args, " "))
+		return Result{"command": a.path}, nil
+	}
+
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(a.path, a.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(hookEnviron(), eventEnv(ev)...)
+	// Run in its own process group, so that anything the command started is
+	// killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	glog.Infof("Running %v", a.path)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "starting %v failed", a.path)
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	logOutput(a.path, "stdout", &stdout)
+	logOutput(a.path, "stderr", &stderr)
+
+	res := Result{"command": a.path}
+	if status, ok := exitStatus(cmd); ok {
+		res["exitCode"] = strconv.Itoa(status)
+	}
+	if ctx.Err() != nil {
+		// The command was killed, report why rather than the signal
+		return res, ctx.Err()
+	}
+	if err != nil {
+		return res, errors.Wrapf(err, "%v failed", a.path)
+	}
+	return res, nil
+}
+
+// hookEnviron returns our environment without the variables that hold
+// secrets, or the files to read them from.
+func hookEnviron() []string {
+	hidden := map[string]bool{}
+	for _, s := range secrets {
+		hidden[s.env] = true
+		hidden[s.env+"_FILE"] = true
+	}
+
+	var env []string
+	for _, v := range os.Environ() {
+		if !hidden[strings.SplitN(v, "=", 2)[0]] {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+// eventEnv returns the environment variables describing the event.
+func eventEnv(ev *Event) []string {
+	vars := []struct{ name, value string }{
+		{"KIND", ev.Lifecycle()},
+		{"MONITOR", ev.Monitor},
+		{"SUBNET", ev.Subnet},
+		{"TARGET", ev.Target},
+		{"FROM", ev.From},
+		{"TO", ev.To},
+		{"TIME", ev.Time.UTC().Format(time.RFC3339)},
+		{"CONSECUTIVE_FAILURES", strconv.Itoa(ev.ConsecutiveFailures)},
+		{"LAST_ERROR", ev.LastError},
+		{"CURRENT_ROUTE_TABLE", ev.CurrentRouteTable},
+		{"TARGET_ROUTE_TABLE", ev.TargetRouteTable},
+	}
+
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, "NAT_EVENT_"+v.name+"="+v.value)
+	}
+	for _, r := range ev.Results() {
+		env = append(env, fmt.Sprintf("NAT_RESULT_%v=%v", envName(r.Action), r.Status))
+	}
+	return env
+}
+
+func logOutput(command, stream string, output *bytes.Buffer) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		glog.Infof("%v %v: %v", command, stream, scanner.Text())
+	}
+}
+
+func exitStatus(cmd *exec.Cmd) (int, bool) {
+	if cmd.ProcessState == nil {
+		return 0, false
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Exited() {
+		return status.ExitStatus(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempDir creates a directory for the test, returning it and a function that
+// removes it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "nat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeScript(t *testing.T, dir, script string) string {
+	path := filepath.Join(dir, "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExecActionInput(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	out := filepath.Join(dir, "out")
+	path := writeScript(t, dir, `cat > `+out+`
+echo "kind=$NAT_EVENT_KIND subnet=$NAT_EVENT_SUBNET routetable=$NAT_RESULT_ROUTETABLE"
+echo oops >&2
+exit 3
+`)
+	a := &execAction{path: path, timeout: 5 * time.Second}
+
+	ev := testEvent()
+	res := runAction(context.Background(), "exec", a, actionPolicy{retry: backoff{attempts: 1}}, ev)
+	if res.Status != resultError || res.Details["exitCode"] != "3" {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(b, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Kind != eventFailoverFailed || payload.Event.Subnet != "subnet-1" {
+		t.Errorf("unexpected stdin %s", b)
+	}
+}
+
+func TestExecActionEnvironment(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	out := filepath.Join(dir, "out")
+	os.Setenv("NAT_SMTP_PASSWORD", "hunter2")
+	os.Setenv("NAT_WEBHOOK_SECRET_FILE", "/run/secrets/webhook")
+	defer os.Unsetenv("NAT_SMTP_PASSWORD")
+	defer os.Unsetenv("NAT_WEBHOOK_SECRET_FILE")
+	path := writeScript(t, dir, `echo "$NAT_EVENT_KIND $NAT_EVENT_SUBNET $NAT_RESULT_ROUTETABLE $1 [$NAT_SMTP_PASSWORD$NAT_WEBHOOK_SECRET_FILE]" > `+out)
+	a := &execAction{path: path, args: []string{"arg"}, timeout: 5 * time.Second}
+
+	res, err := a.Trigger(context.Background(), testEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["exitCode"] != "0" {
+		t.Errorf("unexpected result %v", res)
+	}
+	b, _ := ioutil.ReadFile(out)
+	if got := strings.TrimSpace(string(b)); got != "failover-failed subnet-1 error arg []" {
+		t.Errorf("unexpected environment %q", got)
+	}
+}
+
+func TestExecActionTimeout(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	a := &execAction{path: writeScript(t, dir, "sleep 10 &\nwait\n"), timeout: 100 * time.Millisecond}
+
+	started := time.Now()
+	_, err := a.Trigger(context.Background(), testEvent())
+	if status := actionStatus(err); status != resultTimeout {
+		t.Errorf("expected timeout, got %v (%v)", status, err)
+	}
+	if took := time.Since(started); took > 5*time.Second {
+		t.Errorf("command was not killed, took %v", took)
+	}
+}
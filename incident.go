@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	incidentURL        string
+	incidentRoutingKey secret
+	incidentSeverity   string
+)
+
+func init() {
+	flag.StringVar(&incidentURL, "incident-url", getEnv("NAT_INCIDENT_URL", "https://events.pagerduty.com"), "Base URL of the PagerDuty Events v2 compatible API")
+	secretVar(&incidentRoutingKey, "incident-routing-key", "NAT_INCIDENT_ROUTING_KEY", "Integration routing key for incident events")
+	flag.StringVar(&incidentSeverity, "incident-severity", getEnv("NAT_INCIDENT_SEVERITY", "critical"), "Severity of triggered incidents")
+}
+
+const (
+	incidentTrigger     = "trigger"
+	incidentAcknowledge = "acknowledge"
+	incidentResolve     = "resolve"
+)
+
+// incidentEvent is a PagerDuty Events v2 request body.
+type incidentEvent struct {
+	RoutingKey  string           `json:"routing_key"`
+	EventAction string           `json:"event_action"`
+	DedupKey    string           `json:"dedup_key"`
+	Payload     *incidentPayload `json:"payload,omitempty"`
+	Links       []incidentLink   `json:"links,omitempty"`
+}
+
+type incidentPayload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Timestamp     string      `json:"timestamp"`
+	Component     string      `json:"component"`
+	Group         string      `json:"group"`
+	Class         string      `json:"class"`
+	CustomDetails interface{} `json:"custom_details"`
+}
+
+type incidentLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+type incidentAction struct {
+	url        string
+	routingKey *secret
+	severity   string
+	client     *http.Client
+	retry      backoff
+}
+
+func makeIncidentAction() *incidentAction {
+	if incidentRoutingKey.Get() == "" {
+		glog.Infof("Skipping incident action due to absent configuration")
+		return nil
+	}
+
+	return &incidentAction{
+		url:        strings.TrimRight(incidentURL, "/") + "/v2/enqueue",
+		routingKey: &incidentRoutingKey,
+		severity:   incidentSeverity,
+		client:     &http.Client{Timeout: webhookTimeout},
+		retry:      backoff{attempts: webhookAttempts, base: 500 * time.Millisecond, max: 5 * time.Second},
+	}
+}
+
+// incidentDedupKey is stable per subnet so that repeated failures update the
+// same incident and a recovery resolves it.
+func incidentDedupKey(subnet string) string {
+	return "nat-my-idea-of-a-good-time/" + subnet
+}
+
+// Trigger opens or updates the incident for a problem, and resolves it when
+// the monitor has recovered.
+func (a *incidentAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	kind := ev.Lifecycle()
+	if kind == eventDigest {
+		// Suppressed updates don't change the state of the incident
+		return nil, errSkipped
+	}
+	if kind == eventRecovered || kind == eventFailedBack {
+		return a.send(ctx, incidentResolve, ev.Subnet, nil)
+	}
+
+	summary := ev.Monitor + " NAT " + kind
+	if ev.LastError != "" {
+		summary += ": " + ev.LastError
+	}
+	payload := &incidentPayload{
+		Summary:   summary,
+		Source:    ev.Monitor,
+		Severity:  a.severity,
+		Timestamp: ev.Time.UTC().Format(time.RFC3339),
+		Component: ev.Subnet,
+		Group:     ev.Monitor,
+		Class:     "nat",
+		CustomDetails: map[string]interface{}{
+			"target":              ev.Target,
+			"consecutiveFailures": ev.ConsecutiveFailures,
+			"failingFor":          ev.FailingFor().String(),
+			"window":              ev.Window,
+			"currentRouteTable":   ev.CurrentRouteTable,
+			"targetRouteTable":    ev.TargetRouteTable,
+			"results":             ev.Results(),
+		},
+	}
+	return a.send(ctx, incidentTrigger, ev.Subnet, payload)
+}
+
+// Acknowledge marks the subnet's incident as being handled.
+func (a *incidentAction) Acknowledge(ctx context.Context, subnet string) (Result, error) {
+	return a.send(ctx, incidentAcknowledge, subnet, nil)
+}
+
+func (a *incidentAction) send(ctx context.Context, action, subnet string, payload *incidentPayload) (Result, error) {
+	req := incidentEvent{
+		RoutingKey:  a.routingKey.Get(),
+		EventAction: action,
+		DedupKey:    incidentDedupKey(subnet),
+		Payload:     payload,
+	}
+	if base := strings.TrimRight(externalURL, "/"); base != "" && payload != nil {
+		req.Links = []incidentLink{{Href: base + "/status", Text: "Monitor status"}}
+	}
+
+	res := Result{"action": action, "dedupKey": req.DedupKey}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return res, errors.Wrap(err, "encoding incident event failed")
+	}
+
+	if dryRun {
+		// Don't log the body, as it contains the routing key
+		glog.Infof("Would be sending incident %v for %v", action, req.DedupKey)
+		return res, nil
+	}
+
+	glog.Infof("Sending incident %v for %v", action, req.DedupKey)
+	err = a.retry.retry(ctx, isRetryableWebhookError, func() error {
+		return postJSON(ctx, a.client, a.url, nil, body)
+	})
+	if err != nil {
+		return res, errors.Wrapf(err, "sending incident %v failed", action)
+	}
+	return res, nil
+}
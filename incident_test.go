@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIncidentTriggerAndResolve(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	var received []incidentEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/enqueue" {
+			t.Errorf("unexpected path %v", r.URL.Path)
+		}
+		var ev incidentEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Error(err)
+		}
+		received = append(received, ev)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	oldURL, oldKey := incidentURL, incidentRoutingKey.value
+	incidentURL, incidentRoutingKey.value = srv.URL, "routing-key"
+	defer func() { incidentURL, incidentRoutingKey.value = oldURL, oldKey }()
+	a := makeIncidentAction()
+
+	failure := testEvent()
+	if _, err := a.Trigger(context.Background(), failure); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Acknowledge(context.Background(), failure.Subnet); err != nil {
+		t.Fatal(err)
+	}
+	recovery := &Event{Kind: eventRecovered, Monitor: failure.Monitor, Subnet: failure.Subnet, From: stateFailed, To: stateHealthy}
+	if _, err := a.Trigger(context.Background(), recovery); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(received))
+	}
+	for i, action := range []string{incidentTrigger, incidentAcknowledge, incidentResolve} {
+		if received[i].EventAction != action {
+			t.Errorf("expected event %v to be %v, got %v", i, action, received[i].EventAction)
+		}
+		if received[i].DedupKey != incidentDedupKey("subnet-1") || received[i].RoutingKey != "routing-key" {
+			t.Errorf("unexpected keys in %+v", received[i])
+		}
+	}
+	if received[0].Payload == nil || received[0].Payload.Severity != "critical" {
+		t.Errorf("expected a critical payload on trigger, got %+v", received[0].Payload)
+	}
+	if received[2].Payload != nil {
+		t.Errorf("expected no payload on resolve")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	notifyEvents     string
+	renotifyInterval time.Duration
+)
+
+func init() {
+	flag.StringVar(&notifyEvents, "notify-events", getEnv("NAT_NOTIFY_EVENTS", "failed,failed-over,failover-failed,recovered,failed-back,drift-detected"), "Comma separated lifecycle events that notifiers are sent by default")
+	flag.DurationVar(&renotifyInterval, "renotify-interval", getEnvMs("NAT_RENOTIFY_INTERVAL_MS", 3600000), "Minimum interval between repeated notifications of the same event during an incident")
+}
+
+// subscription passes on only the lifecycle events a notifier is interested
+// in, and holds back repeats of the same event during an ongoing incident.
+type subscription struct {
+	action   Action
+	events   map[string]bool
+	renotify time.Duration
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+}
+
+// subscriptionEvents returns the lifecycle events the notifier is sent,
+// which default to -notify-events and can be overridden per notifier with
+// NAT_NOTIFY_<NAME>_EVENTS.
+func subscriptionEvents(name string) (map[string]bool, error) {
+	events, err := parseLifecycleEvents(getEnv("NAT_NOTIFY_"+envName(name)+"_EVENTS", notifyEvents))
+	if err != nil {
+		return nil, fmt.Errorf("invalid events for %v: %v", name, err)
+	}
+	return events, nil
+}
+
+// subscribe wraps a notifier with its subscription and throttle. The
+// renotify interval can be overridden per notifier with
+// NAT_NOTIFY_<NAME>_RENOTIFY_MS.
+func subscribe(name string, action Action, events map[string]bool) *subscription {
+	return &subscription{
+		action:   newThrottle(name, action),
+		events:   events,
+		renotify: getEnvMs("NAT_NOTIFY_"+envName(name)+"_RENOTIFY_MS", int(renotifyInterval/time.Millisecond)),
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+func parseLifecycleEvents(s string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, kind := range lifecycleEvents {
+		known[kind] = true
+	}
+
+	events := make(map[string]bool)
+	for _, kind := range splitList(s) {
+		if !known[kind] {
+			return nil, fmt.Errorf("unknown lifecycle event %q", kind)
+		}
+		events[kind] = true
+	}
+	return events, nil
+}
+
+func (s *subscription) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	kind := ev.Lifecycle()
+	if !s.events[kind] {
+		return nil, errSkipped
+	}
+
+	// Notifiers are shared by the monitors, so each subnet has its own incident
+	subnet := ev.Subnet + "/"
+	s.mu.Lock()
+	if kind == eventRecovered {
+		// Only tell people it's fixed if we told them it was broken
+		notified := false
+		for key := range s.lastSent {
+			if strings.HasPrefix(key, subnet) {
+				notified = true
+				delete(s.lastSent, key)
+			}
+		}
+		if !notified {
+			s.mu.Unlock()
+			return nil, errSkipped
+		}
+	} else if last, ok := s.lastSent[subnet+kind]; ok && ev.Time.Sub(last) < s.renotify {
+		s.mu.Unlock()
+		return nil, errSkipped
+	}
+	s.mu.Unlock()
+
+	res, err := s.action.Trigger(ctx, ev)
+	if err == nil && kind != eventRecovered {
+		s.mu.Lock()
+		s.lastSent[subnet+kind] = ev.Time
+		s.mu.Unlock()
+	}
+	return res, err
+}
+
+// notification is the data available to notification templates.
+type notification struct {
+	*Event
+	Title          string
+	Color          string
+	Results        []ActionResult
+	ResultsText    string
+	SuppressedText string
+	StatusURL      string
+	MetricsURL     string
+}
+
+var lifecycleTitles = map[string]struct{ title, color string }{
+	eventDegraded:       {"NAT checks failing", "daa038"},
+	eventFailed:         {"NAT still failing", "d00000"},
+	eventFailedOver:     {"NAT failed over", "d00000"},
+	eventFailoverFailed: {"NAT failover FAILED", "d00000"},
+	eventRecovered:      {"NAT recovered", "2eb886"},
+	eventFailedBack:     {"NAT failed back", "2eb886"},
+	eventDrift:          {"NAT route table drift detected", "daa038"},
+	eventDigest:         {"NAT notification digest", "439fe0"},
+}
+
+func newNotification(ev *Event) notification {
+	title := lifecycleTitles[ev.Lifecycle()]
+	msg := notification{
+		Event:          ev,
+		Title:          ev.Monitor + " " + title.title,
+		Color:          title.color,
+		Results:        ev.Results(),
+		ResultsText:    formatResults(ev.Results()),
+		SuppressedText: formatSuppressed(ev.Suppressed),
+	}
+	for _, r := range msg.Results {
+		if r.Details["dryRun"] == "true" {
+			msg.Title += " (dry run)"
+			break
+		}
+	}
+	if base := strings.TrimRight(externalURL, "/"); base != "" {
+		msg.StatusURL = base + "/status"
+		msg.MetricsURL = base + "/metrics"
+	}
+	return msg
+}
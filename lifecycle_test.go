@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionFiltersAndRenotifies(t *testing.T) {
+	sent := 0
+	notifier := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		sent++
+		return nil, nil
+	})
+	events, err := parseLifecycleEvents("failed,recovered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &subscription{action: notifier, events: events, renotify: time.Hour, lastSent: map[string]time.Time{}}
+
+	now := time.Now()
+	steps := []struct {
+		kind string
+		at   time.Duration
+		want int
+	}{
+		{eventRecovered, 0, 0},          // nothing to recover from yet
+		{eventDegraded, 0, 0},           // not subscribed
+		{eventFailed, 0, 1},             // first notification
+		{eventFailed, time.Minute, 1},   // within the renotify interval
+		{eventFailed, 2 * time.Hour, 2}, // reminder
+		{eventRecovered, 3 * time.Hour, 3},
+		{eventFailed, 3 * time.Hour, 4}, // a new incident notifies straight away
+	}
+	for i, step := range steps {
+		s.Trigger(context.Background(), &Event{Kind: step.kind, Time: now.Add(step.at)})
+		if sent != step.want {
+			t.Errorf("step %v (%v): expected %v notifications, got %v", i, step.kind, step.want, sent)
+		}
+	}
+}
+
+func TestSubscriptionTracksSubnetsSeparately(t *testing.T) {
+	var sent []string
+	notifier := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		sent = append(sent, ev.Subnet+" "+ev.Kind)
+		return nil, nil
+	})
+	events, err := parseLifecycleEvents("failed,recovered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &subscription{action: notifier, events: events, renotify: time.Hour, lastSent: map[string]time.Time{}}
+
+	now := time.Now()
+	for _, ev := range []*Event{
+		{Kind: eventFailed, Subnet: "subnet-1", Time: now},
+		{Kind: eventFailed, Subnet: "subnet-2", Time: now},                     // another incident
+		{Kind: eventFailed, Subnet: "subnet-1", Time: now.Add(time.Minute)},    // within the renotify interval
+		{Kind: eventRecovered, Subnet: "subnet-1", Time: now.Add(time.Minute)}, // ends only subnet-1's incident
+		{Kind: eventFailed, Subnet: "subnet-2", Time: now.Add(2 * time.Minute)},
+		{Kind: eventRecovered, Subnet: "subnet-3", Time: now.Add(2 * time.Minute)}, // never reported as failed
+		{Kind: eventRecovered, Subnet: "subnet-2", Time: now.Add(3 * time.Minute)},
+	} {
+		s.Trigger(context.Background(), ev)
+	}
+
+	expected := []string{"subnet-1 failed", "subnet-2 failed", "subnet-1 recovered", "subnet-2 recovered"}
+	if strings.Join(sent, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected %v, got %v", expected, sent)
+	}
+}
+
+func TestParseLifecycleEventsRejectsUnknown(t *testing.T) {
+	if _, err := parseLifecycleEvents("failed,exploded"); err == nil {
+		t.Errorf("expected an unknown event to be rejected")
+	}
+}
+
+func TestNotificationDescribesDryRunPlan(t *testing.T) {
+	ev := &Event{Kind: eventFailed, Monitor: "a", From: stateDegraded, To: stateFailed}
+	ev.AddResult(ActionResult{
+		Action:  "routetable",
+		Status:  resultSuccess,
+		Details: Result{"dryRun": "true", "plan": "disassociate rtb-1 from subnet-1 (rtbassoc-1)\nassociate rtb-2 with subnet-1"},
+	})
+
+	msg := newNotification(ev)
+	if msg.Title != "a NAT failed over (dry run)" {
+		t.Errorf("unexpected title %q", msg.Title)
+	}
+	if !strings.Contains(msg.ResultsText, "    - associate rtb-2 with subnet-1\n") {
+		t.Errorf("expected the plan in the results, got:\n%v", msg.ResultsText)
+	}
+}
+
+func TestNotifiersRejectInvalidEvents(t *testing.T) {
+	oldURLs := webhookURLs
+	webhookURLs = "http://localhost/hook"
+	os.Setenv("NAT_NOTIFY_WEBHOOK_EVENTS", "failed,exploded")
+	defer func() {
+		webhookURLs = oldURLs
+		os.Unsetenv("NAT_NOTIFY_WEBHOOK_EVENTS")
+	}()
+
+	n := newNotifiers()
+	if err := n.configure(); err == nil || !strings.Contains(err.Error(), "invalid events for webhook") {
+		t.Errorf("expected the invalid events to be reported, got %v", err)
+	}
+	if len(n.channels) != 0 {
+		t.Errorf("expected the notifiers to be left as they were, got %v", n.channels)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -16,10 +21,12 @@ import (
 var (
 	subnetName string
 
-	checkTarget           string
-	checkTimeout          time.Duration
-	checkInterval         time.Duration
-	checkFailureThreshold int
+	checkTarget            string
+	checkTimeout           time.Duration
+	checkInterval          time.Duration
+	checkFailureThreshold  int
+	checkRecoveryThreshold int
+	checkHistorySize       int
 
 	prometheusAddress string
 
@@ -46,6 +53,8 @@ func init() {
 	flag.DurationVar(&checkTimeout, "timeout", getEnvMs("NAT_TIMEOUT_MS", 500), "Timeout for NAT check in milliseconds")
 	flag.DurationVar(&checkInterval, "interval", getEnvMs("NAT_INTERVAL_MS", 1000), "Interval to test connectivity in milliseconds")
 	flag.IntVar(&checkFailureThreshold, "threshold", getEnvInt("NAT_THRESHOLD", 5), "Number of times the check may fail before action is taken")
+	flag.IntVar(&checkRecoveryThreshold, "recovery-threshold", getEnvInt("NAT_RECOVERY_THRESHOLD", 3), "Number of consecutive successful checks before a failed monitor is considered recovered")
+	flag.IntVar(&checkHistorySize, "history", getEnvInt("NAT_HISTORY", 20), "Number of recent check results to include in failure events")
 
 	flag.StringVar(&prometheusAddress, "prometheus", getEnv("NAT_PROMETHEUS", ":8080"), "Address to expose the Prometheus monitoring handler")
 
@@ -55,67 +64,212 @@ func init() {
 	prometheus.MustRegister(checkCount)
 }
 
+// commands are run instead of the monitor, and return the exit status.
+// Those that need the instance discover it first, as the monitor does, and
+// the others run offline.
+var commands = map[string]struct {
+	run           func(args []string) int
+	needsInstance func() bool
+}{
+	"validate": {validateCommand, usesEC2},
+	"check":    {checkCommand, usesFlagMonitor},
+	"status":   {statusCommand, usesEC2},
+	"failover": {failoverCommand, usesEC2},
+	"failback": {failbackCommand, usesEC2},
+	"simulate": {simulateCommand, nil},
+}
+
 func main() {
-	flag.Parse()
+	// The command comes before its flags, e.g. nat-my-idea-of-a-good-time validate -config nat.json
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, ok := commands[args[0]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %v\n", args[0])
+			os.Exit(2)
+		}
+		flag.CommandLine.Parse(args[1:])
+		if command.needsInstance != nil && command.needsInstance() {
+			discover()
+		}
+		status := command.run(flag.Args())
+		glog.Flush()
+		os.Exit(status)
+	}
 
-	if checkTarget == "" {
-		glog.Fatalln("No health check target specified")
+	flag.CommandLine.Parse(args)
+	discover()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		glog.Fatalf("Invalid configuration: %v", err)
 	}
-	if subnetName == "" {
-		subnetName = subnetId
+
+	openAuditLog()
+	budget = newFailoverBudget()
+	configureMaintenance()
+	if err := cfg.apply(true); err != nil {
+		glog.Fatalf("Invalid configuration: %v", err)
 	}
+	logEffectiveConfig()
 
-	fa := newFanoutAction()
-	fa.AddAction("routetable", makeRouteTableFailoverAction())
-	fa.AddAction("email", makeEmailAction())
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigs
+		glog.Infof("Received %v, shutting down", sig)
+		cancel()
+	}()
 
+	// Serve health endpoints during startup, so that readiness can be seen
 	http.Handle("/metrics", prometheus.Handler())
-	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "OK")
-	})
+	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/audit", auditHandler)
+	http.HandleFunc("/config", configHandler)
 	go http.ListenAndServe(prometheusAddress, nil)
 
-	healthChecker(fa)
+	runner := &monitorRunner{
+		ctx:       ctx,
+		notifiers: newNotifiers(),
+		newClient: newEC2Client,
+		saved:     loadState(),
+	}
+	if err := runner.configureActions(); err != nil {
+		glog.Fatalf("Invalid configuration: %v", err)
+	}
+	if err := monitors.apply(runner, cfg.Monitors); err != nil {
+		glog.Fatalf("Failed to start monitors: %v", err)
+	}
+	runner.saved = nil
+	monitors.Ready()
+
+	serveOperatorAPI(http.DefaultServeMux, &operatorAPI{
+		ctx:       ctx,
+		monitors:  monitors,
+		notifiers: runner.notifiers,
+	})
+	startDigests(ctx)
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	watchReloads(ctx, runner, reloads)
+
+	monitors.stopAll()
+	glog.Flush()
 }
 
-func healthChecker(action Action) {
-	ticker := time.Tick(checkInterval)
+// healthChecker runs the monitor's checks until the context is cancelled,
+// and then waits for any actions that are still running to observe the
+// cancellation. Events from other sources, such as drift detection, are
+// dispatched from here too so that they carry the current state.
+func (m *Monitor) healthChecker(ctx context.Context, action Action, initial string) {
+	ticker := time.NewTicker(time.Duration(m.Probe.Interval))
+	defer ticker.Stop()
 
-	consecutiveFailures := 0
-	for range ticker {
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	history := newProbeHistory(m.Probe.History)
+	policy := newPolicyState(m.Policy, initial)
+
+	dispatch := func(ev *Event) {
+		m.status.Dispatched(ev)
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			action.Trigger(ctx, ev)
+			// Save whatever the actions changed, such as the route table
+			persisted.Save()
+		}()
+	}
+
+	transition := func(t policyTransition) {
+		ev := m.event(t.Kind)
+		ev.From, ev.To = t.From, t.To
+		ev.ConsecutiveFailures = t.ConsecutiveFailures
+		ev.FirstFailure = t.FirstFailure
+		ev.LastError = t.Error
+		ev.Window, ev.Probes = history.Stats(), history.Recent()
+		ev.TargetRouteTable = m.Secondary
+		audit(auditEntry{
+			Time:   ev.Time,
+			Type:   auditTransition,
+			Subnet: ev.Subnet,
+			Event:  t.Kind,
+			From:   t.From,
+			To:     t.To,
+			Error:  t.Error,
+		})
+		dispatch(ev)
+		m.recordTransition(TransitionRecord{
+			Time:  ev.Time,
+			Kind:  t.Kind,
+			From:  t.From,
+			To:    t.To,
+			Error: t.Error,
+		})
+	}
+
+	timeout := time.Duration(m.Probe.Timeout)
+	for {
+		select {
+		case <-ticker.C:
+		case ev := <-m.external:
+			ev.From, ev.To = policy.state, policy.state
+			ev.Window, ev.Probes = history.Stats(), history.Recent()
+			dispatch(ev)
+			continue
+		case <-ctx.Done():
+			return
+		}
 		var err error
 
 		started := time.Now()
-		checkChan := checkEndpoint(checkTarget)
+		checkChan := checkEndpoint(m.Probe.Target, timeout)
 		select {
-		case <-time.After(checkTimeout):
-			err = fmt.Errorf("Check timed out after %v", checkTimeout)
-			glog.Errorf("Check timed out after %v", checkTimeout)
-			checkCount.WithLabelValues(subnetName, "timeout").Inc()
+		case <-time.After(timeout):
+			err = fmt.Errorf("Check timed out after %v", timeout)
+			glog.Errorf("Check of %v timed out after %v", m.Name, timeout)
+			checkCount.WithLabelValues(m.Name, "timeout").Inc()
 		case err = <-checkChan:
 		}
-		checkDuration.WithLabelValues(subnetName).
-			Observe(float64(time.Now().Sub(started))/float64(time.Second))
+		took := time.Now().Sub(started)
+		checkDuration.WithLabelValues(m.Name).
+			Observe(float64(took) / float64(time.Second))
 
+		probe := ProbeResult{Time: started, Latency: took}
+		if err != nil {
+			probe.Error = err.Error()
+		}
+		policy.record(probe)
 		if err == nil {
-			checkCount.WithLabelValues(subnetName, "success").Inc()
-			consecutiveFailures = 0
-			glog.Infof("Check succeeded")
+			checkCount.WithLabelValues(m.Name, "success").Inc()
+			glog.Infof("Check of %v succeeded", m.Name)
 		} else {
-			checkCount.WithLabelValues(subnetName, "error").Inc()
-			consecutiveFailures++
-			glog.Errorf("%v consecutive failures", consecutiveFailures)
+			checkCount.WithLabelValues(m.Name, "error").Inc()
+			glog.Errorf("%v consecutive failures of %v", policy.consecutiveFailures, m.Name)
 		}
+		history.Add(probe)
+		m.status.Checked(started, err, policy.consecutiveFailures)
+		silences.updateMetrics(started, m.Name)
+		recordProbe(m.Subnet, probe)
 
-		if consecutiveFailures >= checkFailureThreshold {
-			glog.Errorf("Consecutive failures greater than configured threshold")
-			go action.Trigger(err)
-			consecutiveFailures = 0
+		for _, t := range policy.decide(probe) {
+			switch t.Kind {
+			case eventFailed:
+				glog.Errorf("Consecutive failures greater than configured threshold")
+			case eventRecovered:
+				glog.Infof("Checks of %v have recovered after %v consecutive successes", m.Name, policy.consecutiveSuccesses)
+			}
+			transition(t)
 		}
 	}
 }
 
-func checkEndpoint(host string) chan error {
+func checkEndpoint(host string, timeout time.Duration) chan error {
 	res := make(chan error, 1)
 
 	go func() {
@@ -126,7 +280,7 @@ func checkEndpoint(host string) chan error {
 			return
 		}
 
-		err = doPing(addr, checkTimeout*3/2)
+		err = doPing(addr, timeout*3/2)
 		if err != nil {
 			glog.Errorf("Failed to ping %v: %v", host, err)
 		}
@@ -167,3 +321,20 @@ func getEnvBool(key string, def bool) bool {
 	}
 	return val == "true"
 }
+
+// envName converts an action or notifier name into the form used in
+// environment variable names.
+func envName(name string) string {
+	return strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// splitList splits a comma separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var useMetadata bool
+
+func init() {
+	flag.BoolVar(&useMetadata, "metadata", getEnvBool("NAT_METADATA", true), "Discover the availability zone, region, VPC and subnet from EC2 instance metadata, to default -name, -subnet and the EC2 region")
+}
+
+// Instance describes where the monitor is running, as discovered from
+// instance metadata.
+type Instance struct {
+	InstanceID       string `json:"instanceId"`
+	AvailabilityZone string `json:"availabilityZone"`
+	Region           string `json:"region"`
+	VPC              string `json:"vpc"`
+	Subnet           string `json:"subnet"`
+}
+
+// instance is nil unless discovery succeeded.
+var instance *Instance
+
+func newMetadataClient(endpoint string) *ec2metadata.EC2Metadata {
+	cfg := &aws.Config{
+		// Fail quickly when not running on EC2
+		HTTPClient: &http.Client{Timeout: 2 * time.Second},
+		MaxRetries: aws.Int(1),
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+	return ec2metadata.New(session.New(), cfg)
+}
+
+// discoverInstance reads the instance's placement and the network of its
+// primary interface.
+func discoverInstance(c *ec2metadata.EC2Metadata) (*Instance, error) {
+	get := func(path string) (string, error) {
+		v, err := c.GetMetadata(path)
+		if err == nil && v == "" {
+			err = errors.New("empty response")
+		}
+		return v, errors.Wrapf(err, "failed to get %v", path)
+	}
+
+	in := &Instance{}
+	var err error
+	if in.InstanceID, err = get("instance-id"); err != nil {
+		return nil, err
+	}
+	if in.AvailabilityZone, err = get("placement/availability-zone"); err != nil {
+		return nil, err
+	}
+	// The region is the zone without its letter, e.g. eu-west-1a is in eu-west-1
+	in.Region = in.AvailabilityZone[:len(in.AvailabilityZone)-1]
+
+	mac, err := get("mac")
+	if err != nil {
+		return nil, err
+	}
+	if in.VPC, err = get("network/interfaces/macs/" + mac + "/vpc-id"); err != nil {
+		return nil, err
+	}
+	if in.Subnet, err = get("network/interfaces/macs/" + mac + "/subnet-id"); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// discover looks up the instance, if enabled, and uses it for the defaults
+// of settings that haven't been given.
+func discover() {
+	if !useMetadata {
+		return
+	}
+	in, err := discoverInstance(newMetadataClient(""))
+	if err != nil {
+		glog.Warningf("Instance metadata is unavailable, so nothing will be discovered: %v", err)
+		return
+	}
+	glog.Infof("Running on %v in %v, subnet %v of %v", in.InstanceID, in.AvailabilityZone, in.Subnet, in.VPC)
+	instance = in
+	instance.applyDefaults()
+}
+
+// applyDefaults names the monitor after the availability zone and watches
+// the instance's own subnet, unless told otherwise.
+func (in *Instance) applyDefaults() {
+	if subnetName == "" {
+		subnetName = in.AvailabilityZone
+	}
+	if subnetId == "" {
+		subnetId = in.Subnet
+	}
+}
+
+// usesFlagMonitor reports whether the monitor is described by flags, whose
+// name and subnet default to the instance's.
+func usesFlagMonitor() bool {
+	return configFile == ""
+}
+
+// usesEC2 reports whether a command that uses EC2 needs the instance, for
+// its monitor's defaults or for the region.
+func usesEC2() bool {
+	return usesFlagMonitor() || os.Getenv("AWS_REGION") == ""
+}
+
+// ec2Region returns the region for the EC2 client, which is left to the
+// SDK if AWS_REGION is set or nothing was discovered.
+func ec2Region() *string {
+	if os.Getenv("AWS_REGION") != "" || instance == nil {
+		return nil
+	}
+	return aws.String(instance.Region)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestMetadata serves the given metadata paths like the instance
+// metadata service, until the server is closed.
+func newTestMetadata(paths map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := paths[strings.TrimPrefix(r.URL.Path, "/latest/meta-data/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+	return srv
+}
+
+var testMetadata = map[string]string{
+	"instance-id":                          "i-1234",
+	"placement/availability-zone":          "eu-west-1b",
+	"mac":                                  "0a:01",
+	"network/interfaces/macs/0a:01/vpc-id": "vpc-1",
+	"network/interfaces/macs/0a:01/subnet-id": "subnet-1",
+}
+
+func TestDiscoverInstance(t *testing.T) {
+	srv := newTestMetadata(testMetadata)
+	defer srv.Close()
+	in, err := discoverInstance(newMetadataClient(srv.URL + "/latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Instance{
+		InstanceID:       "i-1234",
+		AvailabilityZone: "eu-west-1b",
+		Region:           "eu-west-1",
+		VPC:              "vpc-1",
+		Subnet:           "subnet-1",
+	}
+	if *in != want {
+		t.Errorf("got %+v, want %+v", *in, want)
+	}
+
+	partial := map[string]string{}
+	for k, v := range testMetadata {
+		partial[k] = v
+	}
+	delete(partial, "network/interfaces/macs/0a:01/subnet-id")
+	partialSrv := newTestMetadata(partial)
+	defer partialSrv.Close()
+	if _, err := discoverInstance(newMetadataClient(partialSrv.URL + "/latest")); err == nil || !strings.Contains(err.Error(), "subnet-id") {
+		t.Errorf("expected the missing subnet to be reported, got %v", err)
+	}
+}
+
+func TestInstanceDefaults(t *testing.T) {
+	oldName, oldSubnet := subnetName, subnetId
+	defer func() { subnetName, subnetId = oldName, oldSubnet }()
+
+	in := &Instance{AvailabilityZone: "eu-west-1b", Subnet: "subnet-1"}
+	subnetName, subnetId = "", ""
+	in.applyDefaults()
+	if subnetName != "eu-west-1b" || subnetId != "subnet-1" {
+		t.Errorf("got name %q and subnet %q, want the discovered ones", subnetName, subnetId)
+	}
+
+	subnetName, subnetId = "nat-a", "subnet-2"
+	in.applyDefaults()
+	if subnetName != "nat-a" || subnetId != "subnet-2" {
+		t.Errorf("got name %q and subnet %q, want the configured ones kept", subnetName, subnetId)
+	}
+}
+
+func TestCommandsNeedingInstance(t *testing.T) {
+	oldConfig, oldRegion := configFile, os.Getenv("AWS_REGION")
+	defer func() {
+		configFile = oldConfig
+		os.Setenv("AWS_REGION", oldRegion)
+	}()
+
+	needs := func(name string) bool {
+		c := commands[name]
+		return c.needsInstance != nil && c.needsInstance()
+	}
+
+	configFile = ""
+	os.Setenv("AWS_REGION", "eu-west-1")
+	for _, name := range []string{"validate", "check", "status", "failover"} {
+		if !needs(name) {
+			t.Errorf("%v should discover the defaults of the monitor described by flags", name)
+		}
+	}
+
+	configFile = "nat.json"
+	for _, name := range []string{"validate", "check", "status", "failback", "simulate"} {
+		if needs(name) {
+			t.Errorf("%v shouldn't need the instance with a config file and a region", name)
+		}
+	}
+
+	os.Setenv("AWS_REGION", "")
+	if !needs("failover") || needs("check") {
+		t.Errorf("only the commands using EC2 should discover the region")
+	}
+	if needs("simulate") {
+		t.Errorf("simulate should run offline")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/golang/glog"
+)
+
+// Monitor watches one subnet's NAT and looks after its route table
+// association.
+type Monitor struct {
+	MonitorConfig
+
+	c           ec2iface.EC2API
+	routeTables *routeTableTracker
+	routeChange sync.Mutex
+	status      *monitorStatus
+	pause       *pauseState
+
+	// external carries drift and operator events to the health checker
+	external chan *Event
+
+	mu          sync.Mutex
+	transitions []TransitionRecord
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// generation is the runner's when the monitor was launched
+	generation int
+}
+
+func newMonitor(cfg MonitorConfig, c ec2iface.EC2API) *Monitor {
+	return &Monitor{
+		MonitorConfig: cfg,
+		c:             c,
+		routeTables:   &routeTableTracker{expected: cfg.Primary},
+		status:        &monitorStatus{state: stateHealthy},
+		pause:         &pauseState{name: cfg.Name},
+		external:      make(chan *Event),
+	}
+}
+
+func (m *Monitor) enabled(action string) bool {
+	return stringIn(action, m.Actions)
+}
+
+// sharedActions are used by every monitor.
+type sharedActions struct {
+	notify Action
+	exec   Action
+}
+
+// pipeline builds the actions run for the monitor's events.
+func (m *Monitor) pipeline(shared *sharedActions) (*Pipeline, error) {
+	p := newPipeline()
+	trigger := unlessSilenced(unlessPaused(m.pause, m.failoverDue))
+
+	var after []string
+	if m.enabled(actionRouteTable) {
+		err := p.AddStage(Stage{
+			Name:      actionRouteTable,
+			Action:    budgeted(budget, makeAction(m.failover)),
+			Condition: trigger,
+		})
+		if err != nil {
+			return nil, err
+		}
+		after = append(after, actionRouteTable)
+	}
+	if shared.exec != nil && m.enabled(actionExec) {
+		err := p.AddStage(Stage{
+			Name:      actionExec,
+			Action:    shared.exec,
+			After:     after,
+			Condition: trigger,
+		})
+		if err != nil {
+			return nil, err
+		}
+		after = append(after, actionExec)
+	}
+	if m.enabled(actionNotify) {
+		err := p.AddStage(Stage{
+			Name:      actionNotify,
+			Action:    shared.notify,
+			After:     after,
+			Condition: notifyUnlessSilenced,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// failoverDue allows failover when the monitor fails, and again each time
+// the threshold is reached while it is still failed and the subnet isn't
+// using the secondary, so that a failover that errored or was refused by the
+// budget is retried.
+func (m *Monitor) failoverDue(ev *Event) bool {
+	if ev.To != stateFailed {
+		return false
+	}
+	return ev.From != stateFailed || m.routeTables.Expected() != m.Secondary
+}
+
+// start runs the monitor in the background until it is stopped.
+func (m *Monitor) start(ctx context.Context, action Action, initial string) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.done = make(chan struct{})
+	m.status.Ready()
+	go func() {
+		defer close(m.done)
+		go m.watchDrift(ctx)
+		m.healthChecker(ctx, action, initial)
+	}()
+}
+
+// stop cancels the monitor and waits for its actions to finish.
+func (m *Monitor) stop() {
+	m.cancel()
+	<-m.done
+}
+
+// monitorSet holds the running monitors.
+type monitorSet struct {
+	mu       sync.Mutex
+	monitors map[string]*Monitor
+	ready    bool
+}
+
+var monitors = &monitorSet{monitors: make(map[string]*Monitor)}
+
+// List returns the monitors ordered by name.
+func (s *monitorSet) List() []*Monitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.monitors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]*Monitor, len(names))
+	for i, name := range names {
+		list[i] = s.monitors[name]
+	}
+	return list
+}
+
+// Get returns the named monitor. The name may be left out when there is
+// only one.
+func (s *monitorSet) Get(name string) (*Monitor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" {
+		if len(s.monitors) == 1 {
+			for _, m := range s.monitors {
+				return m, nil
+			}
+		}
+		return nil, fmt.Errorf("a monitor must be named, one of %v", strings.Join(s.names(), ", "))
+	}
+	m, ok := s.monitors[name]
+	if !ok {
+		return nil, fmt.Errorf("no monitor %v, expected one of %v", name, strings.Join(s.names(), ", "))
+	}
+	return m, nil
+}
+
+func (s *monitorSet) names() []string {
+	var names []string
+	for name := range s.monitors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Ready records that the configured monitors have started.
+func (s *monitorSet) Ready() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = true
+}
+
+func (s *monitorSet) IsReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// monitorRunner starts monitors, so that tests can do without EC2.
+type monitorRunner struct {
+	ctx       context.Context
+	shared    *sharedActions
+	notifiers *notifiers
+	newClient func(subnet string) ec2iface.EC2API
+	saved     *PersistedState
+
+	// generation changes when the shared actions do, so that every
+	// monitor's pipeline is rebuilt
+	generation int
+}
+
+// configureActions builds the shared actions from the current settings.
+// Notifiers are changed in place, but adding, removing or changing the exec
+// hook restarts the monitors, as it changes their pipelines.
+func (r *monitorRunner) configureActions() error {
+	hook, err := makeExecAction()
+	if err != nil {
+		return err
+	}
+	if err := r.notifiers.configure(); err != nil {
+		return err
+	}
+
+	var exec Action
+	if hook != nil {
+		exec = hook
+	}
+	if r.shared == nil || !reflect.DeepEqual(exec, r.shared.exec) {
+		r.shared = &sharedActions{notify: r.notifiers, exec: exec}
+		r.generation++
+	}
+	return nil
+}
+
+// launch validates a monitor against EC2, restores its state, from a
+// monitor it replaces or else from the state file, and starts it.
+func (r *monitorRunner) launch(cfg MonitorConfig, replaces *Monitor) (*Monitor, error) {
+	m := newMonitor(cfg, r.newClient(cfg.Subnet))
+	m.generation = r.generation
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	pipeline, err := m.pipeline(r.shared)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved *MonitorState
+	if replaces != nil {
+		st := replaces.snapshot()
+		saved = &st
+	} else if r.saved != nil {
+		if st, ok := r.saved.Monitors[cfg.Name]; ok {
+			saved = &st
+		}
+	}
+	initial, err := m.restore(saved)
+	if err != nil {
+		return nil, err
+	}
+
+	if replaces != nil {
+		replaces.stop()
+	}
+	m.start(r.ctx, pipeline, initial)
+	return m, nil
+}
+
+// apply starts, stops and replaces monitors to match the configuration.
+// Unchanged monitors carry on undisturbed, and changed ones carry their
+// state over. A monitor that can't be started is reported, leaving any
+// previous version of it running.
+func (s *monitorSet) apply(r *monitorRunner, configs []MonitorConfig) error {
+	current := map[string]*Monitor{}
+	for _, m := range s.List() {
+		current[m.Name] = m
+	}
+
+	var errs []string
+	next := map[string]*Monitor{}
+	for _, cfg := range configs {
+		old := current[cfg.Name]
+		delete(current, cfg.Name)
+		if old != nil && old.generation == r.generation && reflect.DeepEqual(old.MonitorConfig, cfg) {
+			next[cfg.Name] = old
+			continue
+		}
+
+		m, err := r.launch(cfg, old)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", cfg.Name, err))
+			if old != nil {
+				next[cfg.Name] = old
+			}
+			continue
+		}
+		if old != nil {
+			glog.Infof("Restarted monitor %v with its new configuration", cfg.Name)
+		} else {
+			glog.Infof("Started monitor %v for %v", cfg.Name, cfg.Subnet)
+		}
+		next[cfg.Name] = m
+	}
+
+	for name, m := range current {
+		glog.Infof("Stopping monitor %v, which is no longer configured", name)
+		m.stop()
+	}
+
+	s.mu.Lock()
+	s.monitors = next
+	s.mu.Unlock()
+	persisted.Save()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// stopAll stops every monitor, waiting for their actions to finish.
+func (s *monitorSet) stopAll() {
+	var wg sync.WaitGroup
+	for _, m := range s.List() {
+		wg.Add(1)
+		go func(m *Monitor) {
+			defer wg.Done()
+			m.stop()
+		}(m)
+	}
+	wg.Wait()
+}
+
+// reload reads the configuration again and applies it. A configuration
+// that doesn't validate is rejected as a whole.
+func reload(r *monitorRunner) {
+	glog.Infof("Reloading configuration")
+	cfg, err := loadConfig()
+	if err != nil {
+		glog.Errorf("Keeping the current configuration, as the new one is invalid: %v", err)
+		return
+	}
+	if err := cfg.apply(false); err != nil {
+		glog.Errorf("Failed to apply global settings: %v", err)
+	}
+	if err := r.configureActions(); err != nil {
+		glog.Errorf("Keeping the current notifiers and exec hook, as the new ones are invalid: %v", err)
+	}
+	logEffectiveConfig()
+	if err := monitors.apply(r, cfg.Monitors); err != nil {
+		glog.Errorf("Failed to reload some monitors: %v", err)
+	}
+}
+
+// watchReloads reloads the configuration whenever a signal arrives.
+func watchReloads(ctx context.Context, r *monitorRunner, sigs <-chan os.Signal) {
+	for {
+		select {
+		case <-sigs:
+			reload(r)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recordTransition keeps the most recent transitions to be saved.
+func (m *Monitor) recordTransition(rec TransitionRecord) {
+	m.mu.Lock()
+	m.transitions = append(m.transitions, rec)
+	if len(m.transitions) > stateTransitions {
+		m.transitions = m.transitions[len(m.transitions)-stateTransitions:]
+	}
+	m.mu.Unlock()
+	persisted.Save()
+}
+
+// event starts an event for the monitor.
+func (m *Monitor) event(kind string) *Event {
+	return &Event{
+		Kind:              kind,
+		Monitor:           m.Name,
+		Subnet:            m.Subnet,
+		Target:            m.Probe.Target,
+		Time:              time.Now(),
+		CurrentRouteTable: m.routeTables.Expected(),
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// withMonitors replaces the running monitors, returning them and a function
+// that restores the old ones.
+func withMonitors(ms ...*Monitor) (*monitorSet, func()) {
+	old := monitors
+	monitors = &monitorSet{monitors: make(map[string]*Monitor)}
+	for _, m := range ms {
+		monitors.monitors[m.Name] = m
+	}
+	return monitors, func() { monitors = old }
+}
+
+func TestFailoverDue(t *testing.T) {
+	m := newMonitor(testMonitorConfig("a", "subnet-1"), nil)
+	for _, step := range []struct {
+		from, to, table string
+		due             bool
+	}{
+		{stateHealthy, stateDegraded, m.Primary, false},
+		{stateDegraded, stateFailed, m.Primary, true},
+		{stateFailed, stateFailed, m.Primary, true}, // the failover errored or was refused
+		{stateFailed, stateFailed, m.Secondary, false},
+		{stateFailed, stateHealthy, m.Secondary, false},
+	} {
+		m.routeTables.Set(step.table)
+		if due := m.failoverDue(&Event{From: step.from, To: step.to}); due != step.due {
+			t.Errorf("%v to %v on %v: expected %v, got %v", step.from, step.to, step.table, step.due, due)
+		}
+	}
+}
+
+func TestMonitorSetApply(t *testing.T) {
+	c := newFakeEC2()
+	c.associations["subnet-2"] = "rtb-primary"
+	_, restoreMonitors := withMonitors()
+	defer restoreMonitors()
+	oldBudget := budget
+	budget = newFailoverBudget()
+	defer func() { budget = oldBudget }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := &monitorRunner{
+		ctx:       ctx,
+		shared:    &sharedActions{notify: newFanoutAction()},
+		newClient: func(string) ec2iface.EC2API { return c },
+	}
+	defer monitors.stopAll()
+
+	a, b := testMonitorConfig("a", "subnet-1"), testMonitorConfig("b", "subnet-2")
+	if err := monitors.apply(runner, []MonitorConfig{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := monitors.Get("a")
+	second, _ := monitors.Get("b")
+	second.status.Dispatched(&Event{From: stateDegraded, To: stateFailed})
+	second.pause.Pause(time.Now().Add(time.Hour), "token")
+
+	// Change b, drop a and add c
+	b.Policy.Threshold = 10
+	d := testMonitorConfig("c", "subnet-1")
+	if err := monitors.apply(runner, []MonitorConfig{b, d}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.done:
+	default:
+		t.Errorf("expected the removed monitor to have stopped")
+	}
+	if _, err := monitors.Get("a"); err == nil {
+		t.Errorf("expected the removed monitor to be gone")
+	}
+	changed, _ := monitors.Get("b")
+	if changed == second || changed.Policy.Threshold != 10 {
+		t.Errorf("expected the changed monitor to be replaced")
+	}
+	if changed.Report().State != stateFailed {
+		t.Errorf("expected the replacement to carry over the state, got %v", changed.Report().State)
+	}
+	if _, ok := changed.pause.Paused(time.Now()); !ok {
+		t.Errorf("expected the replacement to carry over the pause")
+	}
+
+	// Applying the same configuration leaves the monitors alone
+	if err := monitors.apply(runner, []MonitorConfig{b, d}); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, _ := monitors.Get("b"); unchanged != changed {
+		t.Errorf("expected the unchanged monitor to keep running")
+	}
+
+	// A monitor that fails validation keeps its previous version
+	bad := b
+	bad.Primary = "rtb-missing"
+	if err := monitors.apply(runner, []MonitorConfig{bad, d}); err == nil {
+		t.Errorf("expected the invalid monitor to be reported")
+	}
+	if kept, _ := monitors.Get("b"); kept != changed {
+		t.Errorf("expected the previous version to keep running")
+	}
+}
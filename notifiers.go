@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// notifiers sends notifications through every configured channel. They are
+// rebuilt from the current settings when the configuration is reloaded, and
+// a channel that stays configured keeps its subscription and throttle, and
+// so what has been sent through it.
+type notifiers struct {
+	mu        sync.RWMutex
+	fanout    *FanoutAction
+	incidents *incidentAction
+	channels  map[string]*subscription
+}
+
+func newNotifiers() *notifiers {
+	return &notifiers{
+		fanout:   newFanoutAction(),
+		channels: make(map[string]*subscription),
+	}
+}
+
+func (n *notifiers) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	n.mu.RLock()
+	fanout := n.fanout
+	n.mu.RUnlock()
+	return fanout.Trigger(ctx, ev)
+}
+
+// Incidents returns the incident integration, if one is configured.
+func (n *notifiers) Incidents() *incidentAction {
+	if n == nil {
+		return nil
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.incidents
+}
+
+// configure builds the channels from the current settings. If any of them
+// is invalid, the channels are left as they were.
+func (n *notifiers) configure() error {
+	built := map[string]Action{}
+	events := map[string]map[string]bool{}
+	var errs []string
+	for _, c := range []struct {
+		name string
+		make func() (Action, error)
+	}{
+		{"email", makeEmailAction},
+		{"webhook", makeWebhookAction},
+		{"slack", makeSlackAction},
+		{"teams", makeTeamsAction},
+	} {
+		action, err := c.make()
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else if action != nil {
+			built[c.name] = action
+		}
+	}
+	incidents := makeIncidentAction()
+	if incidents != nil {
+		built["incident"] = incidents
+	}
+	for name := range built {
+		e, err := subscriptionEvents(name)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		events[name] = e
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	fanout := newFanoutAction()
+	for name, action := range built {
+		sub, ok := n.channels[name]
+		if ok {
+			sub.action.(*throttle).setAction(action)
+		} else {
+			sub = subscribe(name, action, events[name])
+			n.channels[name] = sub
+		}
+		fanout.AddAction(name, sub)
+	}
+	n.fanout, n.incidents = fanout, incidents
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Condition decides whether a stage should run, given the results of the
+// stages that have already completed.
+type Condition func(*Event) bool
+
+// Stage is a named step of a Pipeline. A stage starts once every stage named
+// in After has completed, and only runs its action if Condition allows it.
+type Stage struct {
+	Name      string
+	Action    Action
+	After     []string
+	Condition Condition
+}
+
+// Pipeline runs stages respecting their dependencies, so that e.g. the
+// notification can report the outcome of the failover it follows.
+type Pipeline struct {
+	stages   []Stage
+	names    map[string]bool
+	policies map[string]actionPolicy
+}
+
+func newPipeline() *Pipeline {
+	return &Pipeline{
+		names:    make(map[string]bool),
+		policies: make(map[string]actionPolicy),
+	}
+}
+
+// AddStage appends a stage. Dependencies must refer to stages that were
+// added earlier, which also rules out cycles.
+func (p *Pipeline) AddStage(s Stage) error {
+	if s.Action == nil {
+		return nil
+	}
+	if p.names[s.Name] {
+		return fmt.Errorf("duplicate stage %v", s.Name)
+	}
+	for _, dep := range s.After {
+		if !p.names[dep] {
+			return fmt.Errorf("stage %v depends on unknown stage %v", s.Name, dep)
+		}
+	}
+
+	p.names[s.Name] = true
+	p.stages = append(p.stages, s)
+	switch s.Action.(type) {
+	case *FanoutAction, *Pipeline, *notifiers:
+		p.policies[s.Name] = compositePolicy
+	}
+	return nil
+}
+
+// Trigger runs the pipeline to completion and returns the status of every
+// stage. The error lists the stages that did not succeed.
+func (p *Pipeline) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	glog.Infof("Running %v pipeline stages", len(p.stages))
+
+	done := make(map[string]chan struct{}, len(p.stages))
+	for _, s := range p.stages {
+		done[s.Name] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	res := Result{}
+	var wg sync.WaitGroup
+	for _, s := range p.stages {
+		wg.Add(1)
+		go func(s Stage) {
+			defer wg.Done()
+			defer close(done[s.Name])
+
+			for _, dep := range s.After {
+				<-done[dep]
+			}
+
+			status := resultSkipped
+			if s.Condition == nil || s.Condition(ev) {
+				policy, ok := p.policies[s.Name]
+				if !ok {
+					// Looked up each time, as a reload may change it
+					policy = policyFor(s.Name)
+				}
+				status = runAction(ctx, s.Name, s.Action, policy, ev).Status
+			} else {
+				glog.Infof("Skipping stage %v", s.Name)
+				ev.AddResult(ActionResult{Action: s.Name, Status: resultSkipped})
+			}
+
+			mu.Lock()
+			res[s.Name] = status
+			mu.Unlock()
+		}(s)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, s := range p.stages {
+		if status := res[s.Name]; status != resultSuccess && status != resultSkipped {
+			failed = append(failed, fmt.Sprintf("%v (%v)", s.Name, status))
+		}
+	}
+	if len(failed) > 0 {
+		return res, fmt.Errorf("stages did not succeed: %v", strings.Join(failed, ", "))
+	}
+	return res, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (r *recorder) action(name string, delay time.Duration, err error) Action {
+	return makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		time.Sleep(delay)
+		r.mu.Lock()
+		r.order = append(r.order, name)
+		r.mu.Unlock()
+		return nil, err
+	})
+}
+
+func TestPipelineOrderAndConditions(t *testing.T) {
+	rec := &recorder{}
+	p := newPipeline()
+	failover := func(status string) Condition {
+		return func(ev *Event) bool {
+			r, ok := ev.Result("failover")
+			return ok && r.Status == status
+		}
+	}
+	stages := []Stage{
+		{Name: "failover", Action: rec.action("failover", 20*time.Millisecond, errors.New("boom"))},
+		{Name: "notify", Action: rec.action("notify", 0, nil), After: []string{"failover"}},
+		{Name: "escalate", Action: rec.action("escalate", 0, nil), After: []string{"failover"}, Condition: failover(resultError)},
+		{Name: "celebrate", Action: rec.action("celebrate", 0, nil), After: []string{"failover"}, Condition: failover(resultSuccess)},
+	}
+	for _, s := range stages {
+		if err := p.AddStage(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ev := &Event{}
+	res, err := p.Trigger(context.Background(), ev)
+	if err == nil {
+		t.Errorf("expected the failed failover to be reported")
+	}
+
+	want := Result{"failover": "error", "notify": "success", "escalate": "success", "celebrate": resultSkipped}
+	for name, status := range want {
+		if res[name] != status {
+			t.Errorf("expected %v to be %v, got %v", name, status, res[name])
+		}
+	}
+	if len(rec.order) != 3 || rec.order[0] != "failover" {
+		t.Errorf("expected failover to run first and celebrate to be skipped, got %v", rec.order)
+	}
+	if r, ok := ev.Result("celebrate"); !ok || r.Status != resultSkipped {
+		t.Errorf("expected the skipped stage to be visible on the event, got %+v", r)
+	}
+}
+
+func TestPipelineRejectsUnknownDependency(t *testing.T) {
+	p := newPipeline()
+	err := p.AddStage(Stage{Name: "notify", Action: makeAction(nil), After: []string{"failover"}})
+	if err == nil {
+		t.Errorf("expected an unknown dependency to be rejected")
+	}
+}
+
+func TestRunActionTimeout(t *testing.T) {
+	var calls int32
+	hang := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		atomic.AddInt32(&calls, 1)
+		select {}
+	})
+	policy := actionPolicy{timeout: 10 * time.Millisecond, retry: backoff{attempts: 2, base: time.Millisecond, max: time.Millisecond}}
+
+	res := runAction(context.Background(), "hang", hang, policy, &Event{})
+	if res.Status != resultTimeout {
+		t.Errorf("expected a timeout, got %+v", res)
+	}
+	// The first attempt may still be running, so it must not be repeated
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected a single attempt, got %v", n)
+	}
+}
+
+func TestRunActionRetries(t *testing.T) {
+	calls := 0
+	flaky := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		calls++
+		if calls < 2 {
+			return nil, errors.New("try again")
+		}
+		return nil, nil
+	})
+	policy := actionPolicy{retry: backoff{attempts: 3, base: time.Millisecond, max: time.Millisecond}}
+
+	res := runAction(context.Background(), "flaky", flaky, policy, &Event{})
+	if res.Status != resultSuccess || calls != 2 {
+		t.Errorf("expected success on the second attempt, got %+v after %v calls", res, calls)
+	}
+}
+
+func TestRunActionCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wait := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	res := runAction(ctx, "wait", wait, actionPolicy{retry: backoff{attempts: 3}}, &Event{})
+	if res.Status != resultCancelled {
+		t.Errorf("expected cancellation, got %+v", res)
+	}
+}
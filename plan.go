@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+// plan describes the changes a dry run of switchRouteTable would have made,
+// once the DryRun requests have shown that they are permitted.
+func (m *Monitor) plan(ctx context.Context, res Result, associationId, from, to string) (Result, error) {
+	steps := []string{
+		fmt.Sprintf("disassociate %v from %v (%v)", from, m.Subnet, associationId),
+		fmt.Sprintf("associate %v with %v", to, m.Subnet),
+	}
+	changes, err := m.routeChanges(ctx, from, to)
+	if err != nil {
+		// The plan is still worth having without the routes
+		glog.Errorf("Failed to compare the routes of %v and %v: %v", from, to, err)
+		steps = append(steps, fmt.Sprintf("replace the routes of %v with those of %v", from, to))
+	}
+	for _, change := range changes {
+		steps = append(steps, "route "+change)
+	}
+
+	plan := strings.Join(steps, "\n")
+	glog.Infof("Dry run, so not moving %v. The plan was to:\n%v", m.Subnet, plan)
+	res["dryRun"] = "true"
+	res["plan"] = plan
+	return res, nil
+}
+
+// routeChanges describes how the subnet's routes change when it moves from
+// one route table to the other.
+func (m *Monitor) routeChanges(ctx context.Context, from, to string) ([]string, error) {
+	req := ec2.DescribeRouteTablesInput{
+		RouteTableIds: []*string{aws.String(from), aws.String(to)},
+	}
+	var out *ec2.DescribeRouteTablesOutput
+	err := ec2Call(ctx, m.Name, "DescribeRouteTables", func() error {
+		var err error
+		out, err = m.c.DescribeRouteTables(&req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := map[string]map[string]string{}
+	for _, table := range out.RouteTables {
+		targets := map[string]string{}
+		for _, route := range table.Routes {
+			dest := aws.StringValue(route.DestinationCidrBlock)
+			if dest == "" {
+				dest = aws.StringValue(route.DestinationPrefixListId)
+			}
+			targets[dest] = routeTarget(route)
+		}
+		routes[aws.StringValue(table.RouteTableId)] = targets
+	}
+
+	var dests []string
+	seen := map[string]bool{}
+	for _, id := range []string{from, to} {
+		for dest := range routes[id] {
+			if !seen[dest] {
+				seen[dest] = true
+				dests = append(dests, dest)
+			}
+		}
+	}
+	sort.Strings(dests)
+
+	var changes []string
+	for _, dest := range dests {
+		old, ok := routes[from][dest]
+		if !ok {
+			old = "none"
+		}
+		next, ok := routes[to][dest]
+		if !ok {
+			next = "none"
+		}
+		if old != next {
+			changes = append(changes, fmt.Sprintf("%v: %v -> %v", dest, old, next))
+		}
+	}
+	return changes, nil
+}
+
+// routeTarget returns where the route sends traffic.
+func routeTarget(route *ec2.Route) string {
+	for _, id := range []*string{
+		route.NatGatewayId,
+		route.InstanceId,
+		route.NetworkInterfaceId,
+		route.VpcPeeringConnectionId,
+		route.GatewayId,
+	} {
+		if aws.StringValue(id) != "" {
+			return aws.StringValue(id)
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+// policyState applies a monitor's policy to its probe results, deciding when
+// it is degraded, failed and recovered. It only knows the time from the
+// results it is given, so that recorded results can be replayed through it.
+type policyState struct {
+	policy PolicyConfig
+
+	state                string
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	firstFailure         time.Time
+	failedSince          time.Time
+}
+
+func newPolicyState(policy PolicyConfig, initial string) *policyState {
+	return &policyState{policy: policy, state: initial}
+}
+
+// policyTransition is a change of state decided by the policy.
+type policyTransition struct {
+	Kind                string
+	From                string
+	To                  string
+	ConsecutiveFailures int
+	FirstFailure        time.Time
+	Error               string
+}
+
+// record counts a probe result towards the thresholds.
+func (p *policyState) record(probe ProbeResult) {
+	if probe.Error == "" {
+		p.consecutiveFailures = 0
+		p.consecutiveSuccesses++
+		p.firstFailure = time.Time{}
+		return
+	}
+	if p.consecutiveFailures == 0 {
+		p.firstFailure = probe.Time
+	}
+	p.consecutiveFailures++
+	p.consecutiveSuccesses = 0
+}
+
+// decide returns the transitions called for by the recorded probe results,
+// the last of which was probe. Each failure threshold reached fails the
+// monitor again, so that a failover that errored or was refused is attempted
+// again while the subnet isn't using the secondary.
+func (p *policyState) decide(probe ProbeResult) []policyTransition {
+	var transitions []policyTransition
+	if p.state == stateHealthy && probe.Error != "" {
+		p.failedSince = p.firstFailure
+		transitions = append(transitions, p.transition(eventDegraded, stateDegraded, probe.Error))
+	}
+
+	if p.consecutiveFailures >= p.policy.Threshold {
+		transitions = append(transitions, p.transition(eventFailed, stateFailed, probe.Error))
+		p.consecutiveFailures = 0
+		p.firstFailure = time.Time{}
+	}
+
+	if p.state != stateHealthy && p.consecutiveSuccesses >= p.policy.RecoveryThreshold {
+		transitions = append(transitions, p.transition(eventRecovered, stateHealthy, ""))
+	}
+	return transitions
+}
+
+func (p *policyState) transition(kind, to, lastError string) policyTransition {
+	t := policyTransition{
+		Kind:                kind,
+		From:                p.state,
+		To:                  to,
+		ConsecutiveFailures: p.consecutiveFailures,
+		FirstFailure:        p.firstFailure,
+		Error:               lastError,
+	}
+	if to == stateHealthy {
+		t.FirstFailure = p.failedSince
+	}
+	p.state = to
+	return t
+}
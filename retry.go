@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	awsMaxAttempts   int
+	awsRetryBase     time.Duration
+	awsRetryMax      time.Duration
+	failoverDeadline time.Duration
+	startupTimeout   time.Duration
+
+	ec2RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "natcheck_ec2_request_duration_seconds",
+		Help:    "The time taken for each EC2 API request attempt",
+		Buckets: prometheus.ExponentialBuckets(0.025, 2, 10),
+	},
+		[]string{"subnet", "operation"},
+	)
+	ec2RequestResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "natcheck_ec2_request_total",
+		Help: "The count of EC2 API request attempts, labelled with the returned error code",
+	},
+		[]string{"subnet", "operation", "code"},
+	)
+)
+
+func init() {
+	flag.IntVar(&awsMaxAttempts, "aws-max-attempts", getEnvInt("NAT_AWS_MAX_ATTEMPTS", 5), "Maximum number of attempts for each EC2 API call")
+	flag.DurationVar(&awsRetryBase, "aws-retry-base", getEnvMs("NAT_AWS_RETRY_BASE_MS", 100), "Base delay for exponential backoff between EC2 API attempts")
+	flag.DurationVar(&awsRetryMax, "aws-retry-max", getEnvMs("NAT_AWS_RETRY_MAX_MS", 2000), "Maximum delay between EC2 API attempts")
+	flag.DurationVar(&failoverDeadline, "failover-deadline", getEnvMs("NAT_FAILOVER_DEADLINE_MS", 15000), "Total time allowed for a route table failover, including retries")
+	flag.DurationVar(&startupTimeout, "startup-timeout", getEnvMs("NAT_STARTUP_TIMEOUT_MS", 120000), "Time allowed for startup validation to ride out transient EC2 errors")
+
+	prometheus.MustRegister(ec2RequestDuration)
+	prometheus.MustRegister(ec2RequestResults)
+}
+
+// backoff describes a retry policy using exponential backoff with full jitter.
+// A non-positive attempts value means retries are only bounded by the deadline.
+type backoff struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+func awsBackoff() backoff {
+	return backoff{attempts: awsMaxAttempts, base: awsRetryBase, max: awsRetryMax}
+}
+
+// delay returns how long to sleep after the given (zero based) failed attempt.
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.max
+	if attempt < 32 {
+		if exp := b.base << uint(attempt); exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retry calls f until it succeeds, returns an error that retryable rejects,
+// runs out of attempts, or the context is done or its deadline would pass
+// before the next attempt. The last error seen is returned unchanged so
+// callers can still inspect it.
+func (b backoff) retry(ctx context.Context, retryable func(error) bool, f func() error) error {
+	deadline, hasDeadline := ctx.Deadline()
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if b.attempts > 0 && attempt+1 >= b.attempts {
+			glog.Errorf("Giving up after %v attempts: %v", attempt+1, err)
+			return err
+		}
+
+		wait := b.delay(attempt)
+		if hasDeadline && time.Now().Add(wait).After(deadline) {
+			glog.Errorf("Giving up after %v attempts, deadline reached: %v", attempt+1, err)
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// ec2Call runs a single EC2 operation for a monitor with retries and records
+// metrics for every attempt.
+func ec2Call(ctx context.Context, monitor, op string, f func() error) error {
+	return awsBackoff().retry(ctx, isRetryableAWSError, func() error {
+		started := time.Now()
+		err := f()
+		ec2RequestDuration.WithLabelValues(monitor, op).
+			Observe(float64(time.Now().Sub(started)) / float64(time.Second))
+		ec2RequestResults.WithLabelValues(monitor, op, awsErrorCode(err)).Inc()
+
+		if err != nil && isRetryableAWSError(err) {
+			glog.Warningf("EC2 %v failed with a transient error: %v", op, err)
+		}
+		return err
+	})
+}
+
+var retryableAWSCodes = map[string]bool{
+	"RequestError":         true,
+	"RequestTimeout":       true,
+	"RequestLimitExceeded": true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestThrottled":     true,
+	"InternalError":        true,
+	"InternalFailure":      true,
+	"Unavailable":          true,
+	"ServiceUnavailable":   true,
+}
+
+func isRetryableAWSError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return retryableAWSCodes[awsErr.Code()]
+	}
+	return false
+}
+
+func awsErrorCode(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "Unknown"
+}
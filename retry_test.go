@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestBackoffRetriesThrottling(t *testing.T) {
+	b := backoff{attempts: 5, base: time.Millisecond, max: 2 * time.Millisecond}
+
+	calls := 0
+	err := b.retry(context.Background(), isRetryableAWSError, func() error {
+		calls++
+		if calls < 3 {
+			return awserr.New("RequestLimitExceeded", "slow down", nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %v", calls)
+	}
+}
+
+func TestBackoffStopsOnPermanentError(t *testing.T) {
+	b := backoff{attempts: 5, base: time.Millisecond, max: 2 * time.Millisecond}
+
+	calls := 0
+	err := b.retry(context.Background(), isRetryableAWSError, func() error {
+		calls++
+		return awserr.New("InvalidRouteTableID.NotFound", "missing", nil)
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected a single failed call, got %v calls and %v", calls, err)
+	}
+}
+
+func TestBackoffRespectsAttemptsAndDeadline(t *testing.T) {
+	throttled := awserr.New("Throttling", "slow down", nil)
+
+	calls := 0
+	b := backoff{attempts: 3, base: time.Millisecond, max: time.Millisecond}
+	err := b.retry(context.Background(), isRetryableAWSError, func() error {
+		calls++
+		return throttled
+	})
+	if err != throttled || calls != 3 {
+		t.Errorf("expected 3 calls returning the last error, got %v calls and %v", calls, err)
+	}
+
+	calls = 0
+	b = backoff{base: time.Hour, max: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err = b.retry(ctx, func(error) bool { return true }, func() error {
+		calls++
+		return errors.New("boom")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected the deadline to stop retries, got %v calls and %v", calls, err)
+	}
+}
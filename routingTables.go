@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
@@ -10,70 +13,299 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+const defaultRouteCidr = "0.0.0.0/0"
+
 var (
 	subnetId              string
 	primaryRouteTableId   string
 	secondaryRouteTableId string
+
+	confirmTimeout  time.Duration
+	confirmInterval time.Duration
+	driftInterval   time.Duration
+
+	routePropagationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "natcheck_route_propagation_seconds",
+		Help:    "The time taken for a new route table association to become observable",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	},
+		[]string{"subnet"},
+	)
 )
 
 func init() {
 	flag.StringVar(&subnetId, "subnet", getEnv("NAT_SUBNET", ""), "Subnet ID")
 	flag.StringVar(&primaryRouteTableId, "primary", getEnv("NAT_PRIMARY", ""), "Primary route table id")
 	flag.StringVar(&secondaryRouteTableId, "secondary", getEnv("NAT_SECONDARY", ""), "Secondary route table id")
+
+	flag.DurationVar(&confirmTimeout, "confirm-timeout", getEnvMs("NAT_CONFIRM_TIMEOUT_MS", 30000), "Time to wait for a new route table association to become observable")
+	flag.DurationVar(&confirmInterval, "confirm-interval", getEnvMs("NAT_CONFIRM_INTERVAL_MS", 1000), "Interval between checks for a new route table association")
+	flag.DurationVar(&driftInterval, "drift-interval", getEnvMs("NAT_DRIFT_INTERVAL_MS", 60000), "Interval between checks that the subnet uses the expected route table, 0 to disable")
+
+	prometheus.MustRegister(routePropagationDuration)
 }
 
-func makeRouteTableFailoverAction() Action {
-	c := ec2.New(session.New(&aws.Config{}))
+// unconfirmedError is returned when a route table change was applied but
+// could not be observed before the confirmation timeout.
+type unconfirmedError struct {
+	err error
+}
 
-	validateSubnetId(c, subnetId)
-	validateRouteTableId(c, primaryRouteTableId, "primary")
-	validateRouteTableId(c, secondaryRouteTableId, "secondary")
+func (e unconfirmedError) Error() string {
+	return fmt.Sprintf("applied but not confirmed: %v", e.err)
+}
+
+// routeTableTracker records which route table the subnet should be using,
+// and which it was last seen using.
+type routeTableTracker struct {
+	mu         sync.Mutex
+	expected   string
+	observed   string
+	observedAt time.Time
+}
+
+func (t *routeTableTracker) Expected() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.expected
+}
+
+func (t *routeTableTracker) Set(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expected = id
+}
 
-	return makeAction(func(err error) error {
-		return failoverRouteTable(c, err)
+// Observe records the route table the subnet was found to use.
+func (t *routeTableTracker) Observe(id string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observed, t.observedAt = id, at
+}
+
+func (t *routeTableTracker) Observed() (string, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.observed, t.observedAt
+}
+
+func newEC2Client(subnet string) ec2iface.EC2API {
+	// Retries are handled by ec2Call so that they share the failover deadline
+	c := ec2.New(session.New(&aws.Config{MaxRetries: aws.Int(0), Region: ec2Region()}))
+	auditEC2Requests(&c.Handlers, subnet)
+	return c
+}
+
+// validate checks that the monitor's subnet and route tables exist.
+func (m *Monitor) validate() error {
+	err := checkWithRetry("subnet", func(ctx context.Context) error {
+		return m.validateSubnetId(ctx)
 	})
+	if err == nil {
+		err = checkWithRetry("primary route table", func(ctx context.Context) error {
+			return m.validateRouteTableId(ctx, m.Primary, "primary")
+		})
+	}
+	if err == nil {
+		err = checkWithRetry("secondary route table", func(ctx context.Context) error {
+			return m.validateRouteTableId(ctx, m.Secondary, "secondary")
+		})
+	}
+	return err
+}
+
+func (m *Monitor) failover(ctx context.Context, ev *Event) (Result, error) {
+	return m.switchRouteTable(ctx, m.Primary, m.Secondary)
+}
+
+func (m *Monitor) failback(ctx context.Context, ev *Event) (Result, error) {
+	return m.switchRouteTable(ctx, m.Secondary, m.Primary)
 }
 
-func failoverRouteTable(c *ec2.EC2, _ error) error {
-	glog.Infof("Moving route table over to %v", secondaryRouteTableId)
+// switchRouteTable moves the subnet from one route table to the other and
+// waits for the change to be observable. Changes are serialised, as they may
+// be requested by the health checker and operators at the same time. In a
+// dry run the requests only check that the change is permitted, and the
+// result describes what would have been changed.
+func (m *Monitor) switchRouteTable(ctx context.Context, from, to string) (Result, error) {
+	m.routeChange.Lock()
+	defer m.routeChange.Unlock()
 
-	associationId, err := findAssociationId(c, primaryRouteTableId, subnetId)
+	glog.Infof("Moving route table for %v from %v over to %v", m.Subnet, from, to)
+	res := Result{
+		"from":   from,
+		"to":     to,
+		"subnet": m.Subnet,
+	}
+	mutateCtx, cancel := context.WithTimeout(ctx, failoverDeadline)
+	defer cancel()
+
+	associationId, err := m.findAssociationId(mutateCtx, from)
 	if err != nil {
-		glog.Errorf("Could not find association ID. This could indicate that we have already failed over. Erroring anyway")
-		return errors.Wrap(err, "finding primary route table association id for subnet failed")
+		glog.Errorf("Could not find association ID. This could indicate that we have already moved to %v. Erroring anyway", to)
+		return res, errors.Wrapf(err, "finding %v route table association id for subnet failed", from)
 	}
 
 	disassocReq := &ec2.DisassociateRouteTableInput{
 		DryRun:        &dryRun,
 		AssociationId: &associationId,
 	}
-	_, err = c.DisassociateRouteTable(disassocReq)
+	err = ec2Call(mutateCtx, m.Name, "DisassociateRouteTable", func() error {
+		_, err := m.c.DisassociateRouteTable(disassocReq)
+		return err
+	})
+	if dryRun {
+		err = dryRunPermitted(err)
+	}
 	if err != nil {
-		return errors.Wrap(err, "primary route table disassociation failed")
+		return res, errors.Wrapf(err, "%v route table disassociation failed", from)
 	}
 
+	// Once the old table is gone the subnet falls back to the VPC's main route
+	// table, so the association must be attempted even if we are shutting down
+	assocCtx, cancel := context.WithTimeout(context.Background(), failoverDeadline)
+	defer cancel()
+
 	assocReq := &ec2.AssociateRouteTableInput{
 		DryRun:       &dryRun,
-		RouteTableId: &secondaryRouteTableId,
-		SubnetId:     &subnetId,
+		RouteTableId: &to,
+		SubnetId:     &m.Subnet,
 	}
 
-	_, err = c.AssociateRouteTable(assocReq)
+	err = ec2Call(assocCtx, m.Name, "AssociateRouteTable", func() error {
+		out, err := m.c.AssociateRouteTable(assocReq)
+		if err == nil {
+			res["associationId"] = aws.StringValue(out.AssociationId)
+		}
+		return err
+	})
+	if dryRun {
+		err = dryRunPermitted(err)
+	}
 	if err != nil {
-		return errors.Wrap(err, "secondary route table association failed")
+		return res, errors.Wrapf(err, "%v route table association failed", to)
+	}
+	if dryRun {
+		return m.plan(mutateCtx, res, associationId, from, to)
 	}
+	m.routeTables.Set(to)
 
-	return nil
+	return res, m.waitForAssociation(ctx, to)
+}
+
+// waitForAssociation polls until the subnet resolves to the given route table
+// and that table's default route is active.
+func (m *Monitor) waitForAssociation(ctx context.Context, routeTableId string) error {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	for {
+		err := m.checkAssociation(ctx, routeTableId)
+		if err == nil {
+			took := time.Now().Sub(started)
+			routePropagationDuration.WithLabelValues(m.Name).
+				Observe(float64(took) / float64(time.Second))
+			glog.Infof("Association of %v with %v confirmed after %v", m.Subnet, routeTableId, took)
+			return nil
+		}
+
+		if time.Now().Add(confirmInterval).After(deadline) {
+			return unconfirmedError{err}
+		}
+		glog.Infof("Waiting for association to propagate: %v", err)
+		select {
+		case <-time.After(confirmInterval):
+		case <-ctx.Done():
+			return unconfirmedError{err}
+		}
+	}
 }
 
-func findAssociationId(c *ec2.EC2, routeTableId, subnetId string) (string, error) {
+// subnetRouteTable returns the route table explicitly associated with the
+// subnet, or nil if it uses the VPC's main route table.
+func (m *Monitor) subnetRouteTable(ctx context.Context) (*ec2.RouteTable, error) {
+	req := ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("association.subnet-id"),
+			Values: []*string{&m.Subnet},
+		}},
+	}
+
+	var res *ec2.DescribeRouteTablesOutput
+	err := ec2Call(ctx, m.Name, "DescribeRouteTables", func() error {
+		var err error
+		res, err = m.c.DescribeRouteTables(&req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(res.RouteTables) {
+	case 0:
+		return nil, nil
+	case 1:
+		return res.RouteTables[0], nil
+	}
+	return nil, fmt.Errorf("subnet %v resolves to %v route tables", m.Subnet, len(res.RouteTables))
+}
+
+// associatedRouteTable returns the ID of the route table the subnet uses.
+func (m *Monitor) associatedRouteTable(ctx context.Context) (string, error) {
+	routeTable, err := m.subnetRouteTable(ctx)
+	if err != nil {
+		return "main", err
+	}
+	id := "main"
+	if routeTable != nil {
+		id = aws.StringValue(routeTable.RouteTableId)
+	}
+	m.routeTables.Observe(id, time.Now())
+	return id, nil
+}
+
+func (m *Monitor) checkAssociation(ctx context.Context, routeTableId string) error {
+	routeTable, err := m.subnetRouteTable(ctx)
+	if err != nil {
+		return err
+	}
+	if routeTable == nil {
+		return fmt.Errorf("subnet %v has no explicit route table association", m.Subnet)
+	}
+	if aws.StringValue(routeTable.RouteTableId) != routeTableId {
+		return fmt.Errorf("subnet %v is still associated with %v", m.Subnet, aws.StringValue(routeTable.RouteTableId))
+	}
+
+	for _, route := range routeTable.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) != defaultRouteCidr {
+			continue
+		}
+		if state := aws.StringValue(route.State); state != ec2.RouteStateActive {
+			return fmt.Errorf("default route in %v is %v", routeTableId, state)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("route table %v has no default route", routeTableId)
+}
+
+func (m *Monitor) findAssociationId(ctx context.Context, routeTableId string) (string, error) {
 	req := ec2.DescribeRouteTablesInput{
 		RouteTableIds: []*string{&routeTableId},
 	}
 
-	res, err := c.DescribeRouteTables(&req)
+	var res *ec2.DescribeRouteTablesOutput
+	err := ec2Call(ctx, m.Name, "DescribeRouteTables", func() error {
+		var err error
+		res, err = m.c.DescribeRouteTables(&req)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -84,39 +316,99 @@ func findAssociationId(c *ec2.EC2, routeTableId, subnetId string) (string, error
 	routeTable := res.RouteTables[0]
 
 	for _, assoc := range routeTable.Associations {
-		if *assoc.SubnetId == subnetId {
+		if *assoc.SubnetId == m.Subnet {
 			return *assoc.RouteTableAssociationId, nil
 		}
 	}
 
-	return "", fmt.Errorf("Could not find associationID for subnet %v and route table %v", subnetId, routeTableId)
+	return "", fmt.Errorf("Could not find associationID for subnet %v and route table %v", m.Subnet, routeTableId)
+}
+
+// watchDrift periodically compares the subnet's route table with the one we
+// expect it to use, and reports each new discrepancy once.
+func (m *Monitor) watchDrift(ctx context.Context) {
+	if driftInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(driftInterval)
+	defer ticker.Stop()
+
+	reported := ""
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		actual, err := m.associatedRouteTable(ctx)
+		if err != nil {
+			glog.Errorf("Drift check failed: %v", err)
+			continue
+		}
+
+		expected := m.routeTables.Expected()
+		if actual == expected {
+			reported = ""
+			continue
+		}
+		if actual == reported {
+			continue
+		}
+		reported = actual
+
+		glog.Warningf("Subnet %v is associated with %v, expected %v", m.Subnet, actual, expected)
+		ev := m.event(eventDrift)
+		ev.CurrentRouteTable, ev.TargetRouteTable = actual, expected
+		select {
+		case m.external <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkWithRetry runs a startup check, retrying transient EC2 errors until
+// the startup timeout elapses.
+func checkWithRetry(what string, check func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	defer cancel()
+	b := backoff{base: awsRetryBase, max: awsRetryMax}
+
+	err := b.retry(ctx, isRetryableAWSError, func() error {
+		return check(ctx)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to validate %v", what)
+	}
+	return nil
 }
 
-func validateRouteTableId(c *ec2.EC2, id, key string) {
+func (m *Monitor) validateRouteTableId(ctx context.Context, id, key string) error {
 	if id == "" {
-		glog.Fatalf("No %v route table id given", key)
+		return fmt.Errorf("No %v route table id given", key)
 	}
 	req := ec2.DescribeRouteTablesInput{
 		RouteTableIds: []*string{&id},
 	}
 
 	// Don't need to inspect the result, as a missing value will result in err != nil
-	_, err := c.DescribeRouteTables(&req)
-	if err != nil {
-		glog.Fatalf("Failed to find route table: %v", err)
-	}
+	return ec2Call(ctx, m.Name, "DescribeRouteTables", func() error {
+		_, err := m.c.DescribeRouteTables(&req)
+		return err
+	})
 }
 
-func validateSubnetId(c *ec2.EC2, id string) {
-	if id == "" {
-		glog.Fatalf("No subnet id given")
+func (m *Monitor) validateSubnetId(ctx context.Context) error {
+	if m.Subnet == "" {
+		return fmt.Errorf("No subnet id given")
 	}
 	req := ec2.DescribeSubnetsInput{
-		SubnetIds: []*string{&id},
+		SubnetIds: []*string{&m.Subnet},
 	}
 
-	_, err := c.DescribeSubnets(&req)
-	if err != nil {
-		glog.Fatalf("Failed to find route table: %v", err)
-	}
+	return ec2Call(ctx, m.Name, "DescribeSubnets", func() error {
+		_, err := m.c.DescribeSubnets(&req)
+		return err
+	})
 }
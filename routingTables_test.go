@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/pkg/errors"
+)
+
+// fakeEC2 is an in-memory stand-in for the handful of EC2 calls we make.
+// Association changes only become visible after propagationDelay.
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	mu               sync.Mutex
+	associations     map[string]string // subnet -> route table
+	defaultRoute     map[string]string // route table -> state of its 0.0.0.0/0 route
+	pending          map[string]string
+	visibleAt        time.Time
+	propagationDelay time.Duration
+	calls            []string
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{
+		associations: map[string]string{"subnet-1": "rtb-primary"},
+		defaultRoute: map[string]string{
+			"rtb-primary":   ec2.RouteStateActive,
+			"rtb-secondary": ec2.RouteStateActive,
+		},
+	}
+}
+
+func (f *fakeEC2) settle() {
+	if f.pending != nil && !time.Now().Before(f.visibleAt) {
+		f.associations = f.pending
+		f.pending = nil
+	}
+}
+
+func (f *fakeEC2) routeTable(id string) *ec2.RouteTable {
+	rt := &ec2.RouteTable{RouteTableId: aws.String(id)}
+	if state, ok := f.defaultRoute[id]; ok {
+		rt.Routes = []*ec2.Route{{
+			DestinationCidrBlock: aws.String(defaultRouteCidr),
+			NatGatewayId:         aws.String("nat-" + id),
+			State:                aws.String(state),
+		}}
+	}
+	for subnet, table := range f.associations {
+		if table == id {
+			rt.Associations = append(rt.Associations, &ec2.RouteTableAssociation{
+				RouteTableAssociationId: aws.String("rtbassoc-" + subnet + "-" + id),
+				RouteTableId:            aws.String(id),
+				SubnetId:                aws.String(subnet),
+			})
+		}
+	}
+	return rt
+}
+
+func (f *fakeEC2) DescribeRouteTables(in *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "DescribeRouteTables")
+	f.settle()
+
+	out := &ec2.DescribeRouteTablesOutput{}
+	for _, id := range in.RouteTableIds {
+		if _, ok := f.defaultRoute[*id]; !ok {
+			return nil, awserr.New("InvalidRouteTableID.NotFound", fmt.Sprintf("%v does not exist", *id), nil)
+		}
+		out.RouteTables = append(out.RouteTables, f.routeTable(*id))
+	}
+	for _, filter := range in.Filters {
+		if aws.StringValue(filter.Name) != "association.subnet-id" {
+			continue
+		}
+		for _, subnet := range filter.Values {
+			if table, ok := f.associations[*subnet]; ok {
+				out.RouteTables = append(out.RouteTables, f.routeTable(table))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) DescribeSubnets(in *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "DescribeSubnets")
+
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, id := range in.SubnetIds {
+		out.Subnets = append(out.Subnets, &ec2.Subnet{SubnetId: id})
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) DisassociateRouteTable(in *ec2.DisassociateRouteTableInput) (*ec2.DisassociateRouteTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "DisassociateRouteTable")
+	if aws.BoolValue(in.DryRun) {
+		return nil, awserr.New("DryRunOperation", "Request would have succeeded", nil)
+	}
+
+	for subnet, table := range f.associations {
+		if "rtbassoc-"+subnet+"-"+table == *in.AssociationId {
+			delete(f.associations, subnet)
+			return &ec2.DisassociateRouteTableOutput{}, nil
+		}
+	}
+	return nil, awserr.New("InvalidAssociationID.NotFound", *in.AssociationId, nil)
+}
+
+func (f *fakeEC2) AssociateRouteTable(in *ec2.AssociateRouteTableInput) (*ec2.AssociateRouteTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "AssociateRouteTable")
+	if aws.BoolValue(in.DryRun) {
+		return nil, awserr.New("DryRunOperation", "Request would have succeeded", nil)
+	}
+
+	next := map[string]string{}
+	for subnet, table := range f.associations {
+		next[subnet] = table
+	}
+	next[*in.SubnetId] = *in.RouteTableId
+	f.pending = next
+	f.visibleAt = time.Now().Add(f.propagationDelay)
+	f.settle()
+
+	return &ec2.AssociateRouteTableOutput{
+		AssociationId: aws.String("rtbassoc-" + *in.SubnetId + "-" + *in.RouteTableId),
+	}, nil
+}
+
+func testMonitorConfig(name, subnet string) MonitorConfig {
+	return MonitorConfig{
+		Name:      name,
+		Subnet:    subnet,
+		Primary:   "rtb-primary",
+		Secondary: "rtb-secondary",
+		Probe: ProbeConfig{
+			Target:   "127.0.0.1",
+			Timeout:  Duration(100 * time.Millisecond),
+			Interval: Duration(time.Hour),
+		},
+		Policy:  PolicyConfig{Threshold: 3, RecoveryThreshold: 2},
+		Actions: monitorActions,
+	}
+}
+
+// newTestMonitor returns a monitor of subnet-1 using c, with dry run off,
+// and a function that restores the globals.
+func newTestMonitor(c ec2iface.EC2API) (*Monitor, func()) {
+	oldDryRun, oldTimeout, oldInterval := dryRun, confirmTimeout, confirmInterval
+	dryRun = false
+	confirmTimeout, confirmInterval = 200*time.Millisecond, 10*time.Millisecond
+	return newMonitor(testMonitorConfig("test", "subnet-1"), c), func() {
+		dryRun, confirmTimeout, confirmInterval = oldDryRun, oldTimeout, oldInterval
+	}
+}
+
+func TestFailoverRouteTableWaitsForPropagation(t *testing.T) {
+	c := newFakeEC2()
+	c.propagationDelay = 50 * time.Millisecond
+	m, restore := newTestMonitor(c)
+	defer restore()
+
+	res, err := m.failover(context.Background(), &Event{Subnet: "subnet-1"})
+	if err != nil {
+		t.Fatalf("expected failover to succeed, got %v", err)
+	}
+	if res["associationId"] != "rtbassoc-subnet-1-rtb-secondary" {
+		t.Errorf("expected the new association id in the result, got %v", res)
+	}
+	if table := c.associations["subnet-1"]; table != "rtb-secondary" {
+		t.Errorf("expected subnet to be associated with the secondary, got %v", table)
+	}
+}
+
+func TestFailoverRouteTableDryRun(t *testing.T) {
+	c := newFakeEC2()
+	m, restore := newTestMonitor(c)
+	defer restore()
+	dryRun = true
+
+	res, err := m.failover(context.Background(), &Event{Subnet: "subnet-1"})
+	if err != nil {
+		t.Fatalf("expected the DryRunOperation responses to count as success, got %v", err)
+	}
+	if table := c.associations["subnet-1"]; table != "rtb-primary" {
+		t.Errorf("expected the subnet to be left alone, got %v", table)
+	}
+	if m.routeTables.Expected() != "rtb-primary" {
+		t.Errorf("expected the expected route table to be unchanged, got %v", m.routeTables.Expected())
+	}
+	want := "disassociate rtb-primary from subnet-1 (rtbassoc-subnet-1-rtb-primary)\n" +
+		"associate rtb-secondary with subnet-1\n" +
+		"route 0.0.0.0/0: nat-rtb-primary -> nat-rtb-secondary"
+	if res["dryRun"] != "true" || res["plan"] != want {
+		t.Errorf("unexpected plan %q", res["plan"])
+	}
+}
+
+func TestFailoverRouteTableUnconfirmed(t *testing.T) {
+	c := newFakeEC2()
+	c.defaultRoute["rtb-secondary"] = ec2.RouteStateBlackhole
+	m, restore := newTestMonitor(c)
+	defer restore()
+
+	_, err := m.failover(context.Background(), &Event{Subnet: "subnet-1"})
+	if _, ok := errors.Cause(err).(unconfirmedError); !ok {
+		t.Fatalf("expected an unconfirmed error, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// redacted replaces secrets wherever configuration is shown.
+const redacted = "REDACTED"
+
+// secret is a setting that can be given directly, or read from a file so
+// that it needn't appear in the environment. The file is read again whenever
+// it changes. Its value is never shown, by String or otherwise.
+type secret struct {
+	name  string
+	env   string
+	value string
+
+	mu         sync.Mutex
+	file       string // from the -name-file flag
+	configFile string // from the config file's secrets
+	read       string
+	readFrom   string
+	modTime    time.Time
+	size       int64
+}
+
+// secrets are the secret settings by flag name.
+var secrets = map[string]*secret{}
+
+// secretVar registers s as the name flag, with a name-file flag for a file
+// to read it from. Their defaults come from env and env_FILE.
+func secretVar(s *secret, name, env, usage string) {
+	s.name, s.env = name, env
+	s.value = getEnv(env, "")
+	s.file = getEnv(env+"_FILE", "")
+	flag.Var(s, name, usage)
+	flag.StringVar(&s.file, name+"-file", s.file, "File to read -"+name+" from, which is read again when it changes")
+	secrets[name] = s
+}
+
+func (s *secret) Set(v string) error {
+	s.value = v
+	return nil
+}
+
+func (s *secret) String() string {
+	if s == nil || s.value == "" {
+		return ""
+	}
+	return redacted
+}
+
+// path returns the file the secret is read from, if any.
+func (s *secret) path() string {
+	if s.configFile != "" {
+		return s.configFile
+	}
+	return s.file
+}
+
+// Get returns the secret. A file that can't be read is reported, and the
+// last value read from it is used.
+func (s *secret) Get() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path()
+	if path == "" {
+		return s.value
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		glog.Errorf("Failed to read %v: %v", s.name, err)
+		return s.read
+	}
+	if path == s.readFrom && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.read
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.Errorf("Failed to read %v: %v", s.name, err)
+		return s.read
+	}
+	if s.readFrom != "" {
+		glog.Infof("Reloaded %v from %v", s.name, path)
+	}
+	s.read = strings.TrimRight(string(b), "\r\n")
+	s.readFrom, s.modTime, s.size = path, info.ModTime(), info.Size()
+	return s.read
+}
+
+// redact removes the secret from text, such as an error including it.
+func (s *secret) redact(text string) string {
+	if v := s.Get(); v != "" {
+		return strings.Replace(text, v, redacted, -1)
+	}
+	return text
+}
+
+// setConfigFile sets the file given for the secret in the config file.
+func (s *secret) setConfigFile(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configFile = path
+}
+
+// EffectiveConfig is what the monitor is running with, as logged at startup
+// and served on /config. Secrets are always redacted.
+type EffectiveConfig struct {
+	Flags  map[string]string `json:"flags"`
+	Config *Config           `json:"config"`
+}
+
+var (
+	effectiveMu     sync.Mutex
+	effectiveConfig *Config
+)
+
+// setEffectiveConfig records the configuration that has been applied.
+func setEffectiveConfig(cfg *Config) {
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+	effectiveConfig = cfg
+}
+
+func currentEffectiveConfig() EffectiveConfig {
+	effectiveMu.Lock()
+	defer effectiveMu.Unlock()
+
+	e := EffectiveConfig{Flags: map[string]string{}, Config: effectiveConfig}
+	flag.VisitAll(func(f *flag.Flag) {
+		e.Flags[f.Name] = f.Value.String()
+	})
+	return e
+}
+
+func logEffectiveConfig() {
+	b, err := json.Marshal(currentEffectiveConfig())
+	if err != nil {
+		glog.Errorf("Failed to encode the effective configuration: %v", err)
+		return
+	}
+	glog.Infof("Effective configuration: %s", b)
+}
+
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentEffectiveConfig())
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maintenanceWindows string
+	maintenanceMode    string
+
+	activeSilences = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "natcheck_active_silences",
+		Help: "The number of active maintenance windows and silences, by what they suppress",
+	},
+		[]string{"subnet", "mode"},
+	)
+)
+
+func init() {
+	flag.StringVar(&maintenanceWindows, "maintenance-windows", getEnv("NAT_MAINTENANCE_WINDOWS", ""), "Semicolon separated maintenance windows, either start/end RFC3339 timestamps or cron(min hour dom month dow)/duration in UTC")
+	flag.StringVar(&maintenanceMode, "maintenance-mode", getEnv("NAT_MAINTENANCE_MODE", silenceActions), "What maintenance windows suppress: actions (notifications are still sent) or all")
+
+	prometheus.MustRegister(activeSilences)
+}
+
+// Silence modes. Probes and metrics carry on regardless.
+const (
+	silenceActions = "actions"
+	silenceAll     = "all"
+)
+
+// Silence suppresses automatic actions, and optionally notifications, for a
+// period.
+type Silence struct {
+	ID        string    `json:"id"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Mode      string    `json:"mode"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+}
+
+// maintenanceWindow is a scheduled period of maintenance.
+type maintenanceWindow interface {
+	// active returns the occurrence of the window that covers now, if any
+	active(now time.Time) (start, end time.Time, ok bool)
+	String() string
+}
+
+type fixedWindow struct {
+	start, end time.Time
+}
+
+func (w fixedWindow) active(now time.Time) (time.Time, time.Time, bool) {
+	return w.start, w.end, !now.Before(w.start) && now.Before(w.end)
+}
+
+func (w fixedWindow) String() string {
+	return w.start.Format(time.RFC3339) + "/" + w.end.Format(time.RFC3339)
+}
+
+// cronWindow starts whenever its schedule matches and lasts for duration.
+type cronWindow struct {
+	spec     string
+	schedule cronSchedule
+	duration time.Duration
+}
+
+func (w cronWindow) active(now time.Time) (time.Time, time.Time, bool) {
+	now = now.UTC()
+	t := now.Truncate(time.Minute)
+	for earliest := now.Add(-w.duration); t.After(earliest); t = t.Add(-time.Minute) {
+		if w.schedule.matches(t) {
+			return t, t.Add(w.duration), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func (w cronWindow) String() string {
+	return "cron(" + w.spec + ")/" + w.duration.String()
+}
+
+// parseMaintenanceWindows parses the -maintenance-windows setting.
+func parseMaintenanceWindows(s string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		slash := strings.LastIndex(item, "/")
+		if slash < 0 {
+			return nil, fmt.Errorf("window %q should be start/end or cron(spec)/duration", item)
+		}
+		first, second := strings.TrimSpace(item[:slash]), strings.TrimSpace(item[slash+1:])
+
+		if strings.HasPrefix(first, "cron(") && strings.HasSuffix(first, ")") {
+			spec := first[len("cron(") : len(first)-1]
+			schedule, err := parseCron(spec)
+			if err != nil {
+				return nil, fmt.Errorf("window %q: %v", item, err)
+			}
+			duration, err := time.ParseDuration(second)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("window %q: invalid duration %q", item, second)
+			}
+			windows = append(windows, cronWindow{spec: spec, schedule: schedule, duration: duration})
+			continue
+		}
+
+		start, err := time.Parse(time.RFC3339, first)
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %v", item, err)
+		}
+		end, err := time.Parse(time.RFC3339, second)
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %v", item, err)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("window %q ends before it starts", item)
+		}
+		windows = append(windows, fixedWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+// cronSchedule matches times against a five field cron specification.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domRestricted, dowRestricted  bool
+}
+
+func parseCron(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron spec %q should have 5 fields", spec)
+	}
+
+	var c cronSchedule
+	var err error
+	ranges := []struct {
+		set      *map[int]bool
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	}
+	for i, r := range ranges {
+		if *r.set, err = parseCronField(fields[i], r.min, r.max); err != nil {
+			return cronSchedule{}, fmt.Errorf("cron spec %q: %v", spec, err)
+		}
+	}
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+	c.domRestricted = fields[2] != "*"
+	c.dowRestricted = fields[4] != "*"
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of *, n, n-m with optional
+// /step suffixes.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside %v-%v", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c cronSchedule) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.domRestricted && c.dowRestricted {
+		// Like cron, either day field matching is enough
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// silencer holds the scheduled maintenance windows and ad-hoc silences.
+type silencer struct {
+	mu       sync.Mutex
+	windows  []maintenanceWindow
+	mode     string
+	silences []Silence
+}
+
+var silences = &silencer{mode: silenceActions}
+
+// configureMaintenance parses the maintenance flags.
+func configureMaintenance() {
+	if err := silences.Configure(maintenanceWindows, maintenanceMode); err != nil {
+		glog.Fatalf("Invalid maintenance settings: %v", err)
+	}
+}
+
+// Configure replaces the scheduled maintenance windows.
+func (s *silencer) Configure(windows, mode string) error {
+	parsed, err := parseMaintenanceWindows(windows)
+	if err != nil {
+		return err
+	}
+	if mode != silenceActions && mode != silenceAll {
+		return fmt.Errorf("invalid maintenance mode %q", mode)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windows = parsed
+	s.mode = mode
+	return nil
+}
+
+// Add creates an ad-hoc silence.
+func (s *silencer) Add(start, end time.Time, mode, reason, by string) (Silence, error) {
+	if mode != silenceActions && mode != silenceAll {
+		return Silence{}, fmt.Errorf("mode must be %v or %v", silenceActions, silenceAll)
+	}
+	if !end.After(start) {
+		return Silence{}, fmt.Errorf("silence must end after it starts")
+	}
+
+	silence := Silence{
+		ID:        fmt.Sprintf("%08x", rand.Uint32()),
+		Start:     start,
+		End:       end,
+		Mode:      mode,
+		Reason:    reason,
+		CreatedBy: by,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.silences = append(s.silences, silence)
+	return silence, nil
+}
+
+// Remove expires the silence with the given id.
+func (s *silencer) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, silence := range s.silences {
+		if silence.ID == id {
+			s.silences = append(s.silences[:i], s.silences[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Adhoc returns the ad-hoc silences that have yet to expire.
+func (s *silencer) Adhoc() []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Silence(nil), s.silences...)
+}
+
+// Restore reinstates saved ad-hoc silences.
+func (s *silencer) Restore(saved []Silence) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.silences = append([]Silence(nil), saved...)
+}
+
+// Active returns the windows and silences in effect, dropping silences that
+// have expired.
+func (s *silencer) Active(now time.Time) []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var active []Silence
+	for _, w := range s.windows {
+		if start, end, ok := w.active(now); ok {
+			active = append(active, Silence{
+				ID:        w.String(),
+				Start:     start,
+				End:       end,
+				Mode:      s.mode,
+				Reason:    "scheduled maintenance",
+				CreatedBy: "schedule",
+			})
+		}
+	}
+
+	current := s.silences[:0]
+	for _, silence := range s.silences {
+		if now.Before(silence.End) {
+			current = append(current, silence)
+			if !now.Before(silence.Start) {
+				active = append(active, silence)
+			}
+		}
+	}
+	s.silences = current
+
+	sort.Sort(silencesByEnd(active))
+	return active
+}
+
+type silencesByEnd []Silence
+
+func (s silencesByEnd) Len() int           { return len(s) }
+func (s silencesByEnd) Less(i, j int) bool { return s[i].End.Before(s[j].End) }
+func (s silencesByEnd) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Mode returns the strongest suppression in effect, or "" if there is none.
+func (s *silencer) Mode(now time.Time) string {
+	mode := ""
+	for _, silence := range s.Active(now) {
+		if silence.Mode == silenceAll {
+			return silenceAll
+		}
+		mode = silenceActions
+	}
+	return mode
+}
+
+func (s *silencer) updateMetrics(now time.Time, monitor string) {
+	counts := map[string]int{silenceActions: 0, silenceAll: 0}
+	for _, silence := range s.Active(now) {
+		counts[silence.Mode]++
+	}
+	for mode, n := range counts {
+		activeSilences.WithLabelValues(monitor, mode).Set(float64(n))
+	}
+}
+
+// unlessSilenced stops automatic actions during maintenance.
+func unlessSilenced(cond Condition) Condition {
+	return func(ev *Event) bool {
+		if mode := silences.Mode(ev.Time); mode != "" {
+			glog.Warningf("Automatic actions are silenced for maintenance")
+			return false
+		}
+		return cond == nil || cond(ev)
+	}
+}
+
+// notifyUnlessSilenced stops notifications during maintenance that
+// suppresses everything.
+func notifyUnlessSilenced(ev *Event) bool {
+	if silences.Mode(ev.Time) == silenceAll {
+		glog.Warningf("Notifications are silenced for maintenance")
+		return false
+	}
+	return true
+}
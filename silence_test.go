@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindows(t *testing.T) {
+	windows, err := parseMaintenanceWindows("2017-03-01T02:00:00Z/2017-03-01T04:00:00Z; cron(30 2 * * 0)/2h; cron(*/15 9-17 1 * *)/5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		window int
+		at     string
+		active bool
+	}{
+		{0, "2017-03-01T01:59:59Z", false},
+		{0, "2017-03-01T03:00:00Z", true},
+		{0, "2017-03-01T04:00:00Z", false},
+		{1, "2017-03-05T02:29:00Z", false}, // a Sunday
+		{1, "2017-03-05T02:30:00Z", true},
+		{1, "2017-03-05T04:29:59Z", true},
+		{1, "2017-03-05T04:30:00Z", false},
+		{1, "2017-03-06T03:00:00Z", false},
+		{2, "2017-03-01T09:46:00Z", true},
+		{2, "2017-03-01T09:51:00Z", false},
+		{2, "2017-03-02T09:46:00Z", false},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.at)
+		if _, _, active := windows[tc.window].active(at); active != tc.active {
+			t.Errorf("window %v at %v: expected active %v", windows[tc.window], tc.at, tc.active)
+		}
+	}
+
+	for _, bad := range []string{"tomorrow", "cron(* * *)/1h", "cron(61 * * * *)/1h", "cron(* * * * *)/never", "2017-03-01T04:00:00Z/2017-03-01T02:00:00Z"} {
+		if _, err := parseMaintenanceWindows(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestSilencesSuppressActions(t *testing.T) {
+	old := silences
+	silences = &silencer{mode: silenceActions}
+	defer func() { silences = old }()
+
+	now := time.Now()
+	ev := &Event{From: stateHealthy, To: stateFailed, Time: now}
+	automatic := unlessSilenced(newMonitor(testMonitorConfig("a", "subnet-1"), nil).failoverDue)
+	if !automatic(ev) || !notifyUnlessSilenced(ev) {
+		t.Fatalf("expected actions without a silence")
+	}
+
+	s, err := silences.Add(now.Add(-time.Minute), now.Add(time.Hour), silenceActions, "patching", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if automatic(ev) || !notifyUnlessSilenced(ev) {
+		t.Errorf("expected only automatic actions to be silenced")
+	}
+
+	silences.Add(now, now.Add(time.Minute), silenceAll, "", "test")
+	if notifyUnlessSilenced(ev) {
+		t.Errorf("expected notifications to be silenced")
+	}
+	if active := silences.Active(now); len(active) != 2 || active[0].Mode != silenceAll {
+		t.Errorf("unexpected active silences %+v", active)
+	}
+
+	silences.Remove(s.ID)
+	if ev.Time = now.Add(2 * time.Minute); !automatic(ev) {
+		t.Errorf("expected actions once the silences ended")
+	}
+	if len(silences.silences) != 0 {
+		t.Errorf("expected expired silences to be dropped")
+	}
+}
+
+func TestOperatorAPISilence(t *testing.T) {
+	old := silences
+	silences = &silencer{mode: silenceActions}
+	defer func() { silences = old }()
+	_, mux, _, cleanup := newTestAPI(newFakeEC2())
+	defer cleanup()
+
+	if code, _ := apiRequest(mux, "/api/silence?duration=2h&mode=loud", "s3cret"); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid mode to be rejected, got %v", code)
+	}
+	code, resp := apiRequest(mux, "/api/silence?duration=2h&mode=all&reason=patching", "s3cret")
+	if code != http.StatusOK || resp.Result["id"] == "" {
+		t.Fatalf("silence failed: %v %+v", code, resp)
+	}
+	if silences.Mode(time.Now()) != silenceAll {
+		t.Errorf("expected the silence to be active")
+	}
+	if code, _ := apiRequest(mux, "/api/unsilence?id="+resp.Result["id"], "s3cret"); code != http.StatusOK {
+		t.Errorf("unsilence failed with %v", code)
+	}
+	if silences.Mode(time.Now()) != "" {
+		t.Errorf("expected the silence to be removed")
+	}
+}
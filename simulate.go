@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// simulateCommand replays recorded probe results through the policy given by
+// the flags, showing when the monitor would have failed over.
+func simulateCommand(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: simulate [flags] FILE [SUBNET], where FILE is an audit log recorded with -audit-probes or a CSV of timestamp,result,latency")
+		return 2
+	}
+	subnet := ""
+	if len(args) > 1 {
+		subnet = args[1]
+	}
+
+	probes, err := readProbes(args[0], subnet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read probes: %v\n", err)
+		return 1
+	}
+
+	cfg := flagMonitorConfig(false)
+	if subnet != "" {
+		cfg.Subnet = subnet
+	}
+	sim := &simulation{
+		out:     os.Stdout,
+		monitor: cfg,
+		budget:  newFailoverBudget(),
+	}
+	sim.run(probes)
+	return 0
+}
+
+// readProbes reads probe results from an audit log, keeping those of the
+// subnet, or from a CSV file.
+func readProbes(path, subnet string) ([]ProbeResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("%v is empty", path)
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			r.ReadByte()
+			continue
+		}
+		if b[0] == '{' {
+			return readAuditProbes(r, subnet)
+		}
+		return readCSVProbes(r)
+	}
+}
+
+func readAuditProbes(r io.Reader, subnet string) ([]ProbeResult, error) {
+	var probes []ProbeResult
+	subnets := map[string]bool{}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; s.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "line %v", line)
+		}
+		if e.Type != auditProbe || (subnet != "" && e.Subnet != subnet) {
+			continue
+		}
+		subnets[e.Subnet] = true
+		probe := ProbeResult{Time: e.Time, Latency: e.Latency, Error: e.Error}
+		if e.Outcome != resultSuccess && probe.Error == "" {
+			probe.Error = e.Outcome
+		}
+		probes = append(probes, probe)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(subnets) > 1 {
+		var names []string
+		for name := range subnets {
+			names = append(names, name)
+		}
+		return nil, fmt.Errorf("the audit log has probes of several subnets, so one of %v must be given", strings.Join(names, ", "))
+	}
+	if len(probes) == 0 {
+		return nil, errors.New("the audit log has no probes, which are only recorded with -audit-probes")
+	}
+	return probes, nil
+}
+
+// readCSVProbes reads rows of an RFC3339 timestamp, a result of ok or the
+// error, and an optional latency as a duration or in milliseconds.
+func readCSVProbes(r io.Reader) ([]ProbeResult, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var probes []ProbeResult
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "timestamp") {
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %v: expected timestamp,result,latency", line)
+		}
+
+		var probe ProbeResult
+		if probe.Time, err = time.Parse(time.RFC3339Nano, record[0]); err != nil {
+			return nil, errors.Wrapf(err, "line %v", line)
+		}
+		switch result := strings.TrimSpace(record[1]); strings.ToLower(result) {
+		case "ok", "success":
+		case "":
+			return nil, fmt.Errorf("line %v: no result given", line)
+		default:
+			probe.Error = result
+		}
+		if len(record) > 2 && record[2] != "" {
+			if probe.Latency, err = parseLatency(record[2]); err != nil {
+				return nil, errors.Wrapf(err, "line %v", line)
+			}
+		}
+		probes = append(probes, probe)
+	}
+	return probes, nil
+}
+
+func parseLatency(s string) (time.Duration, error) {
+	if ms, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// resample applies the interval and timeout being simulated to recorded
+// results. Results closer together than the interval are dropped, and
+// successes slower than the timeout become failures, as they would have
+// been if the monitor had run with those settings.
+func resample(probes []ProbeResult, interval, timeout time.Duration) []ProbeResult {
+	var out []ProbeResult
+	var last time.Time
+	for _, probe := range probes {
+		if !last.IsZero() && probe.Time.Sub(last) < interval {
+			continue
+		}
+		last = probe.Time
+		if probe.Error == "" && timeout > 0 && probe.Latency > timeout {
+			probe.Error = fmt.Sprintf("Check timed out after %v", timeout)
+		}
+		out = append(out, probe)
+	}
+	return out
+}
+
+// simulation replays probe results through a monitor's policy and the
+// failover budget. Failback is left to operators, so it is reported as due
+// when the monitor recovers and assumed to happen then.
+type simulation struct {
+	out     io.Writer
+	monitor MonitorConfig
+	budget  *failoverBudget
+
+	failedOver bool
+}
+
+// simulationSummary counts what happened during a simulation.
+type simulationSummary struct {
+	Probes    int
+	Failures  int
+	Degraded  int
+	Failed    int
+	Failovers int
+	Refused   int
+	Failbacks int
+	Down      time.Duration
+}
+
+func (s *simulation) run(probes []ProbeResult) simulationSummary {
+	probes = resample(probes, time.Duration(s.monitor.Probe.Interval), time.Duration(s.monitor.Probe.Timeout))
+	policy := newPolicyState(s.monitor.Policy, stateHealthy)
+
+	var sum simulationSummary
+	var failedAt time.Time
+	w := tabwriter.NewWriter(s.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tDETAIL")
+	for _, probe := range probes {
+		sum.Probes++
+		if probe.Error != "" {
+			sum.Failures++
+		}
+		policy.record(probe)
+		for _, t := range policy.decide(probe) {
+			at := probe.Time.UTC().Format(time.RFC3339)
+			switch t.Kind {
+			case eventDegraded:
+				sum.Degraded++
+				fmt.Fprintf(w, "%v\t%v\t%v\n", at, t.Kind, t.Error)
+			case eventFailed:
+				sum.Failed++
+				if failedAt.IsZero() {
+					failedAt = probe.Time
+				}
+				fmt.Fprintf(w, "%v\t%v\t%v consecutive failures: %v\n", at, t.Kind, t.ConsecutiveFailures, t.Error)
+				s.failover(w, at, probe.Time, &sum)
+			case eventRecovered:
+				sum.Down += probe.Time.Sub(failedAt)
+				failedAt = time.Time{}
+				fmt.Fprintf(w, "%v\t%v\tafter %v consecutive successes\n", at, t.Kind, s.monitor.Policy.RecoveryThreshold)
+				if s.failedOver {
+					sum.Failbacks++
+					s.failedOver = false
+					fmt.Fprintf(w, "%v\tfailback\tdue, moving %v back to %v, which is left to an operator\n", at, s.monitor.Subnet, s.monitor.Primary)
+				}
+			}
+		}
+	}
+	if !failedAt.IsZero() {
+		sum.Down += probes[len(probes)-1].Time.Sub(failedAt)
+	}
+	w.Flush()
+
+	var span time.Duration
+	if len(probes) > 0 {
+		span = probes[len(probes)-1].Time.Sub(probes[0].Time)
+	}
+	fmt.Fprintf(s.out, "\nReplayed %v probes over %v, of which %v failed, with threshold %v, recovery threshold %v, interval %v and timeout %v.\n",
+		sum.Probes, span, sum.Failures, s.monitor.Policy.Threshold, s.monitor.Policy.RecoveryThreshold,
+		time.Duration(s.monitor.Probe.Interval), time.Duration(s.monitor.Probe.Timeout))
+	fmt.Fprintf(s.out, "Degraded %v times and failed %v times, for %v in all. %v failovers, %v refused by the budget, %v failbacks due.\n",
+		sum.Degraded, sum.Failed, sum.Down, sum.Failovers, sum.Refused, sum.Failbacks)
+	return sum
+}
+
+// failover reports what the routetable action would have done. As in the
+// monitor, each failure threshold reached retries a failover that was
+// refused, until the subnet uses the secondary.
+func (s *simulation) failover(w io.Writer, at string, now time.Time, sum *simulationSummary) {
+	if s.failedOver {
+		fmt.Fprintf(w, "%v\tfailover\tnone, as %v already uses the secondary\n", at, s.monitor.Subnet)
+		return
+	}
+	if err := s.budget.Spend(s.monitor.Subnet, now); err != nil {
+		sum.Refused++
+		fmt.Fprintf(w, "%v\tcooldown\tfailover refused, %v\n", at, err)
+		return
+	}
+	sum.Failovers++
+	s.failedOver = true
+	fmt.Fprintf(w, "%v\tfailover\tmoving %v from %v to %v\n", at, s.monitor.Subnet, s.monitor.Primary, s.monitor.Secondary)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeProbes(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadCSVProbes(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeProbes(t, dir, "probes.csv", `timestamp,result,latency
+2026-01-02T03:04:00Z,ok,25
+2026-01-02T03:04:10Z,Host unreachable,1.5s
+2026-01-02T03:04:20Z,success
+`)
+	probes, err := readProbes(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 3 {
+		t.Fatalf("expected 3 probes, got %+v", probes)
+	}
+	if probes[0].Error != "" || probes[0].Latency != 25*time.Millisecond {
+		t.Errorf("unexpected first probe %+v", probes[0])
+	}
+	if probes[1].Error != "Host unreachable" || probes[1].Latency != 1500*time.Millisecond {
+		t.Errorf("unexpected second probe %+v", probes[1])
+	}
+	if !probes[2].Time.Equal(time.Date(2026, 1, 2, 3, 4, 20, 0, time.UTC)) {
+		t.Errorf("unexpected third probe %+v", probes[2])
+	}
+
+	if _, err := readProbes(writeProbes(t, dir, "bad.csv", "yesterday,ok\n"), ""); err == nil {
+		t.Errorf("expected a bad timestamp to be reported")
+	}
+}
+
+func TestReadAuditProbes(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := writeProbes(t, dir, "audit.log", `{"time":"2026-01-02T03:04:00Z","type":"probe","subnet":"subnet-1","outcome":"success","latency":1000000}
+{"time":"2026-01-02T03:04:05Z","type":"transition","subnet":"subnet-1","event":"degraded"}
+{"time":"2026-01-02T03:04:10Z","type":"probe","subnet":"subnet-2","outcome":"error","error":"timed out"}
+{"time":"2026-01-02T03:04:20Z","type":"probe","subnet":"subnet-1","outcome":"error","error":"unreachable"}
+`)
+	if _, err := readProbes(path, ""); err == nil {
+		t.Errorf("expected a subnet to be required")
+	}
+	probes, err := readProbes(path, "subnet-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(probes) != 2 || probes[0].Latency != time.Millisecond || probes[1].Error != "unreachable" {
+		t.Errorf("unexpected probes %+v", probes)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	var probes []ProbeResult
+	for i, result := range []string{"ok", "fail", "fail", "slow", "ok", "ok", "fail", "fail", "fail"} {
+		probe := ProbeResult{Time: start.Add(time.Duration(i) * 10 * time.Second), Latency: 10 * time.Millisecond}
+		switch result {
+		case "fail":
+			probe.Error = "unreachable"
+		case "slow":
+			probe.Latency = 2 * time.Second
+		}
+		probes = append(probes, probe)
+		// Closer together than the interval, so dropped
+		probes = append(probes, ProbeResult{Time: probe.Time.Add(time.Second), Error: "dropped"})
+	}
+
+	b := newFailoverBudget()
+	b.SetLimits(0, 1, time.Hour)
+	var out bytes.Buffer
+	sim := &simulation{
+		out: &out,
+		monitor: MonitorConfig{
+			Subnet:    "subnet-1",
+			Primary:   "rtb-primary",
+			Secondary: "rtb-secondary",
+			Probe:     ProbeConfig{Interval: Duration(10 * time.Second), Timeout: Duration(time.Second)},
+			Policy:    PolicyConfig{Threshold: 3, RecoveryThreshold: 2},
+		},
+		budget: b,
+	}
+	sum := sim.run(probes)
+
+	expected := simulationSummary{
+		Probes:    9,
+		Failures:  6,
+		Degraded:  2,
+		Failed:    2,
+		Failovers: 1,
+		Refused:   1,
+		Failbacks: 1,
+		Down:      20 * time.Second,
+	}
+	if sum != expected {
+		t.Errorf("expected %+v, got %+v\n%v", expected, sum, out.String())
+	}
+	var lines []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	text := strings.Join(lines, "\n")
+	for _, line := range []string{
+		"2026-01-02T03:04:30Z failed 3 consecutive failures: Check timed out after 1s",
+		"2026-01-02T03:04:30Z failover moving subnet-1 from rtb-primary to rtb-secondary",
+		"2026-01-02T03:04:50Z failback due",
+		"2026-01-02T03:05:20Z cooldown failover refused",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("expected %q in\n%v", line, out.String())
+		}
+	}
+}
+
+func TestSimulationRetriesRefusedFailover(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	var probes []ProbeResult
+	for i := 0; i < 6; i++ {
+		probes = append(probes, ProbeResult{Time: start.Add(time.Duration(i) * 10 * time.Second), Error: "unreachable"})
+	}
+
+	b := newFailoverBudget()
+	b.SetLimits(0, 1, time.Hour)
+	b.Spend("subnet-1", start.Add(-time.Minute))
+	var out bytes.Buffer
+	sim := &simulation{
+		out: &out,
+		monitor: MonitorConfig{
+			Subnet:    "subnet-1",
+			Primary:   "rtb-primary",
+			Secondary: "rtb-secondary",
+			Probe:     ProbeConfig{Interval: Duration(10 * time.Second), Timeout: Duration(time.Second)},
+			Policy:    PolicyConfig{Threshold: 3, RecoveryThreshold: 2},
+		},
+		budget: b,
+	}
+	sum := sim.run(probes)
+	if sum.Failed != 2 || sum.Refused != 2 || sum.Failovers != 0 {
+		t.Errorf("expected each failure to retry the refused failover, got %+v\n%v", sum, out.String())
+	}
+}
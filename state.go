@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var stateFile string
+
+func init() {
+	flag.StringVar(&stateFile, "state-file", getEnv("NAT_STATE_FILE", ""), "File to keep the monitors' state in across restarts, otherwise state is lost when the monitor restarts")
+}
+
+const (
+	stateVersion     = 2
+	stateTransitions = 20
+)
+
+// PersistedState is what the monitors remember across restarts.
+type PersistedState struct {
+	Version  int                     `json:"version"`
+	SavedAt  time.Time               `json:"savedAt"`
+	Monitors map[string]MonitorState `json:"monitors"`
+	Budget   []BudgetUsage           `json:"budget"`
+	Silences []Silence               `json:"silences"`
+}
+
+// MonitorState is what a single monitor remembers.
+type MonitorState struct {
+	Subnet      string             `json:"subnet"`
+	State       string             `json:"state"`
+	RouteTable  string             `json:"routeTable"`
+	Transitions []TransitionRecord `json:"transitions"`
+	PausedUntil time.Time          `json:"pausedUntil,omitempty"`
+	PausedBy    string             `json:"pausedBy,omitempty"`
+}
+
+// TransitionRecord is a state change made by the health checker.
+type TransitionRecord struct {
+	Time  time.Time `json:"time"`
+	Kind  string    `json:"kind"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Error string    `json:"error,omitempty"`
+}
+
+// stateStore writes the monitors' state to a file whenever it changes.
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+var persisted = &stateStore{}
+
+// Snapshot gathers the state to be saved.
+func (s *stateStore) Snapshot() PersistedState {
+	st := PersistedState{
+		Version:  stateVersion,
+		SavedAt:  time.Now(),
+		Monitors: make(map[string]MonitorState),
+		Silences: silences.Adhoc(),
+	}
+	for _, m := range monitors.List() {
+		st.Monitors[m.Name] = m.snapshot()
+	}
+	if budget != nil {
+		st.Budget = budget.Usage()
+	}
+	return st
+}
+
+// snapshot gathers the monitor's state.
+func (m *Monitor) snapshot() MonitorState {
+	m.status.mu.Lock()
+	phase := m.status.state
+	m.status.mu.Unlock()
+
+	st := MonitorState{
+		Subnet:     m.Subnet,
+		State:      phase,
+		RouteTable: m.routeTables.Expected(),
+	}
+	m.mu.Lock()
+	st.Transitions = append([]TransitionRecord(nil), m.transitions...)
+	m.mu.Unlock()
+	if until, ok := m.pause.Paused(time.Now()); ok {
+		st.PausedUntil, st.PausedBy = until, m.pause.By()
+	}
+	return st
+}
+
+// Save writes the current state, if a state file is configured. Failures are
+// logged, as they shouldn't stop the monitors working. The snapshot is taken
+// under the lock, so that concurrent saves can't write an older one last.
+func (s *stateStore) Save() {
+	if s.path == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.MarshalIndent(s.Snapshot(), "", "  ")
+	if err != nil {
+		glog.Errorf("Failed to encode state: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		glog.Errorf("Failed to save state to %v: %v", s.path, err)
+	}
+}
+
+// Load reads the saved state, returning nil if there isn't any usable state.
+func (s *stateStore) Load() *PersistedState {
+	if s.path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		glog.Infof("No saved state in %v, starting afresh", s.path)
+		return nil
+	}
+	if err != nil {
+		glog.Errorf("Failed to read state from %v, starting afresh: %v", s.path, err)
+		return nil
+	}
+
+	var st PersistedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		glog.Errorf("Ignoring corrupt state in %v: %v", s.path, err)
+		return nil
+	}
+	if st.Version != stateVersion {
+		glog.Warningf("Ignoring state in %v with unknown version %v", s.path, st.Version)
+		return nil
+	}
+	return &st
+}
+
+// writeFileAtomic replaces the file so that readers, including the monitor
+// after a crash, see either the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0640)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// loadState reads the state file and restores the state shared by the
+// monitors. Each monitor restores its own state as it starts.
+func loadState() *PersistedState {
+	persisted.path = stateFile
+	st := persisted.Load()
+	if st != nil {
+		glog.Infof("Restoring state saved at %v", st.SavedAt)
+		if budget != nil {
+			budget.Restore(st.Budget)
+		}
+		silences.Restore(st.Silences)
+	}
+	return st
+}
+
+// restore reinstates the monitor's saved state, reconciles it with the
+// subnet's actual route table association and returns the state the health
+// checker should start in.
+func (m *Monitor) restore(st *MonitorState) (string, error) {
+	phase, routeTable := stateHealthy, ""
+	if st != nil && st.Subnet != m.Subnet {
+		glog.Warningf("Ignoring %v state saved for subnet %v", m.Name, st.Subnet)
+		st = nil
+	}
+	if st != nil {
+		glog.Infof("Restoring %v state of %v", st.State, m.Name)
+		phase, routeTable = st.State, st.RouteTable
+		m.transitions = st.Transitions
+		if time.Now().Before(st.PausedUntil) {
+			m.pause.Pause(st.PausedUntil, st.PausedBy)
+		}
+		m.status.mu.Lock()
+		m.status.state = phase
+		m.status.mu.Unlock()
+	}
+
+	var actual string
+	err := checkWithRetry("route table association", func(ctx context.Context) error {
+		var err error
+		actual, err = m.associatedRouteTable(ctx)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	m.routeTables.Set(m.reconcileRouteTable(routeTable, actual))
+	return phase, nil
+}
+
+// reconcileRouteTable decides which route table the monitor should expect.
+// EC2 is the authority when the subnet uses one of our tables, as it may have
+// been changed while we were down. Otherwise we keep what we expected, so that
+// drift detection reports it.
+func (m *Monitor) reconcileRouteTable(saved, actual string) string {
+	expected := saved
+	if expected == "" {
+		expected = m.Primary
+	}
+	if actual == expected {
+		return expected
+	}
+
+	glog.Warningf("Subnet %v is associated with %v, expected %v", m.Subnet, actual, expected)
+	res := Result{"saved": saved, "actual": actual}
+	if actual == m.Primary || actual == m.Secondary {
+		expected = actual
+	}
+	res["expected"] = expected
+	audit(auditEntry{
+		Type:    auditAction,
+		Subnet:  m.Subnet,
+		Action:  "reconcile",
+		Outcome: resultSuccess,
+		Result:  res,
+	})
+	return expected
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withStateGlobals replaces the persisted state, returning a function that
+// restores it.
+func withStateGlobals(t *testing.T) func() {
+	dir, cleanup := tempDir(t)
+	oldBudget, oldSilences, oldPersisted, oldStateFile := budget, silences, persisted, stateFile
+	budget = newFailoverBudget()
+	silences = &silencer{mode: silenceActions}
+	persisted = &stateStore{}
+	stateFile = filepath.Join(dir, "state.json")
+	return func() {
+		budget, silences, persisted, stateFile = oldBudget, oldSilences, oldPersisted, oldStateFile
+		cleanup()
+	}
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	defer withStateGlobals(t)()
+	c := newFakeEC2()
+	m, restore := newTestMonitor(c)
+	defer restore()
+	_, restoreMonitors := withMonitors(m)
+	defer restoreMonitors()
+
+	loadState()
+	if initial, err := m.restore(nil); err != nil || initial != stateHealthy || m.routeTables.Expected() != "rtb-primary" {
+		t.Fatalf("expected to start healthy on the primary, got %v on %v: %v", initial, m.routeTables.Expected(), err)
+	}
+
+	// Fail over, spending the budget, and add a silence and a pause
+	now := time.Now()
+	budget.Spend("subnet-1", now)
+	c.associations["subnet-1"] = "rtb-secondary"
+	m.routeTables.Set("rtb-secondary")
+	m.status.Dispatched(&Event{From: stateDegraded, To: stateFailed})
+	silences.Add(now, now.Add(time.Hour), silenceActions, "patching", "token")
+	m.pause.Pause(now.Add(time.Hour), "token")
+	m.recordTransition(TransitionRecord{Time: now, Kind: eventFailed, From: stateDegraded, To: stateFailed})
+
+	files, _ := ioutil.ReadDir(filepath.Dir(stateFile))
+	if len(files) != 1 {
+		t.Errorf("expected only the state file to be left behind, got %v files", len(files))
+	}
+
+	// Restart
+	budget, silences, persisted = newFailoverBudget(), &silencer{mode: silenceActions}, &stateStore{}
+	m, restore = newTestMonitor(c)
+	defer restore()
+	_, restoreMonitors = withMonitors(m)
+	defer restoreMonitors()
+
+	saved := loadState()
+	if saved == nil {
+		t.Fatalf("expected saved state")
+	}
+	st := saved.Monitors["test"]
+	if initial, err := m.restore(&st); err != nil || initial != stateFailed {
+		t.Errorf("expected to resume in the failed state, got %v: %v", initial, err)
+	}
+	if m.routeTables.Expected() != "rtb-secondary" {
+		t.Errorf("expected the secondary to be active, got %v", m.routeTables.Expected())
+	}
+	if status := budget.Status(); len(status) != 2 || status[1].Used != 1 {
+		t.Errorf("expected budget usage to be restored, got %+v", status)
+	}
+	if active := silences.Active(time.Now()); len(active) != 1 || active[0].Reason != "patching" {
+		t.Errorf("expected the silence to be restored, got %+v", active)
+	}
+	if _, ok := m.pause.Paused(time.Now()); !ok || m.pause.By() != "token" {
+		t.Errorf("expected the pause to be restored")
+	}
+	if len(m.transitions) != 1 {
+		t.Errorf("expected the transition to be restored, got %+v", m.transitions)
+	}
+}
+
+func TestStateReconcilesWithEC2(t *testing.T) {
+	m, restore := newTestMonitor(newFakeEC2())
+	defer restore()
+
+	// An operator failed back by hand while the monitor was down
+	st := &MonitorState{Subnet: "subnet-1", State: stateFailed, RouteTable: "rtb-secondary"}
+	if _, err := m.restore(st); err != nil {
+		t.Fatal(err)
+	}
+	if m.routeTables.Expected() != "rtb-primary" {
+		t.Errorf("expected EC2's association to win, got %v", m.routeTables.Expected())
+	}
+
+	// Tables we don't manage are left for drift detection to report
+	if expected := m.reconcileRouteTable("rtb-secondary", "rtb-other"); expected != "rtb-secondary" {
+		t.Errorf("expected to keep the saved table, got %v", expected)
+	}
+}
+
+func TestStateIgnoresOtherSubnets(t *testing.T) {
+	defer withStateGlobals(t)()
+	m, restore := newTestMonitor(newFakeEC2())
+	defer restore()
+
+	st := &MonitorState{Subnet: "subnet-2", State: stateFailed}
+	if initial, _ := m.restore(st); initial != stateHealthy {
+		t.Errorf("expected state saved for another subnet to be ignored, got %v", initial)
+	}
+
+	persisted.path = stateFile
+	ioutil.WriteFile(stateFile, []byte(`{"version":`), 0640)
+	if persisted.Load() != nil {
+		t.Errorf("expected corrupt state to be ignored")
+	}
+	ioutil.WriteFile(stateFile, []byte(`{"version":1,"subnet":"subnet-1","state":"failed"}`), 0640)
+	if persisted.Load() != nil {
+		t.Errorf("expected state in an old format to be ignored")
+	}
+}
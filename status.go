@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var livenessTimeout time.Duration
+
+func init() {
+	flag.DurationVar(&livenessTimeout, "liveness-timeout", getEnvMs("NAT_LIVENESS_TIMEOUT_MS", 30000), "Time without a completed check after which /healthz reports the monitor as wedged, in milliseconds")
+}
+
+// monitorStatus tracks what a monitor's health checker is doing, for the
+// status and health endpoints.
+type monitorStatus struct {
+	mu                  sync.Mutex
+	ready               bool
+	readyAt             time.Time
+	state               string
+	lastCheck           time.Time
+	lastError           string
+	consecutiveFailures int
+	lastEvent           *Event
+}
+
+// Ready records that the monitor has started.
+func (m *monitorStatus) Ready() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ready = true
+	m.readyAt = time.Now()
+}
+
+// Checked records the outcome of a health check.
+func (m *monitorStatus) Checked(at time.Time, err error, consecutiveFailures int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastCheck = at
+	m.lastError = ""
+	if err != nil {
+		m.lastError = err.Error()
+	}
+	m.consecutiveFailures = consecutiveFailures
+}
+
+// Dispatched records an event being sent to the actions, whose results are
+// reported as they complete.
+func (m *monitorStatus) Dispatched(ev *Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = ev.To
+	m.lastEvent = ev
+}
+
+// StatusReport is the document served on /status.
+type StatusReport struct {
+	Ready    bool            `json:"ready"`
+	Monitors []MonitorReport `json:"monitors"`
+	Budget   []BudgetStatus  `json:"budget,omitempty"`
+	Silences []Silence       `json:"silences,omitempty"`
+	DryRun   bool            `json:"dryRun"`
+	Instance *Instance       `json:"instance,omitempty"`
+}
+
+// MonitorReport describes a single monitor.
+type MonitorReport struct {
+	Monitor             string        `json:"monitor"`
+	Subnet              string        `json:"subnet"`
+	Target              string        `json:"target"`
+	State               string        `json:"state"`
+	LastCheck           *time.Time    `json:"lastCheck,omitempty"`
+	LastCheckOK         bool          `json:"lastCheckOK"`
+	LastError           string        `json:"lastError,omitempty"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	RouteTable          RouteTables   `json:"routeTable"`
+	LastEvent           *EventSummary `json:"lastEvent,omitempty"`
+	PausedUntil         *time.Time    `json:"pausedUntil,omitempty"`
+}
+
+// RouteTables describes the subnet's route table association. Expected is
+// the table the monitor last chose, and Observed the one the subnet was
+// using when last checked, such as by drift detection.
+type RouteTables struct {
+	Expected   string     `json:"expected"`
+	Observed   string     `json:"observed,omitempty"`
+	ObservedAt *time.Time `json:"observedAt,omitempty"`
+	Primary    string     `json:"primary"`
+	Secondary  string     `json:"secondary"`
+}
+
+// EventSummary describes the last event and the outcomes of its actions.
+type EventSummary struct {
+	Kind    string         `json:"kind"`
+	Time    time.Time      `json:"time"`
+	Results []ActionResult `json:"results"`
+}
+
+// Report describes the monitor.
+func (m *Monitor) Report() MonitorReport {
+	s := m.status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := MonitorReport{
+		Monitor:             m.Name,
+		Subnet:              m.Subnet,
+		Target:              m.Probe.Target,
+		State:               s.state,
+		LastCheckOK:         !s.lastCheck.IsZero() && s.lastError == "",
+		LastError:           s.lastError,
+		ConsecutiveFailures: s.consecutiveFailures,
+		RouteTable: RouteTables{
+			Expected:  m.routeTables.Expected(),
+			Primary:   m.Primary,
+			Secondary: m.Secondary,
+		},
+	}
+	if observed, at := m.routeTables.Observed(); observed != "" {
+		report.RouteTable.Observed, report.RouteTable.ObservedAt = observed, &at
+	}
+	if !s.lastCheck.IsZero() {
+		lastCheck := s.lastCheck
+		report.LastCheck = &lastCheck
+	}
+	if s.lastEvent != nil {
+		report.LastEvent = &EventSummary{
+			Kind:    s.lastEvent.Lifecycle(),
+			Time:    s.lastEvent.Time,
+			Results: s.lastEvent.Results(),
+		}
+	}
+	if until, ok := m.pause.Paused(time.Now()); ok {
+		report.PausedUntil = &until
+	}
+	return report
+}
+
+// Report describes every monitor and the settings they share.
+func (s *monitorSet) Report() StatusReport {
+	report := StatusReport{
+		Ready:    s.IsReady(),
+		Monitors: []MonitorReport{},
+		Silences: silences.Active(time.Now()),
+		DryRun:   dryRun,
+		Instance: instance,
+	}
+	for _, m := range s.List() {
+		report.Monitors = append(report.Monitors, m.Report())
+	}
+	if budget != nil {
+		report.Budget = budget.Status()
+	}
+	return report
+}
+
+// Live reports whether the check loop is still running. The monitor is
+// considered live until it has started, which is bounded by the startup
+// timeout.
+func (m *monitorStatus) Live(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ready {
+		return nil
+	}
+	last := m.lastCheck
+	if last.IsZero() {
+		last = m.readyAt
+	}
+	if since := now.Sub(last); since > livenessTimeout {
+		return fmt.Errorf("no check has completed for %v", since)
+	}
+	return nil
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(monitors.Report())
+}
+
+// healthzHandler fails if any monitor's check loop has stalled.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	for _, m := range monitors.List() {
+		if err := m.status.Live(now); err != nil {
+			http.Error(w, fmt.Sprintf("%v: %v", m.Name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !monitors.IsReady() {
+		http.Error(w, "startup validation has not passed", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
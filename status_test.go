@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	m, restore := newTestMonitor(newFakeEC2())
+	defer restore()
+	set, restoreMonitors := withMonitors()
+	defer restoreMonitors()
+
+	code := func(h http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	if code(readyzHandler) != http.StatusServiceUnavailable || code(healthzHandler) != http.StatusOK {
+		t.Errorf("expected live but not ready during startup")
+	}
+
+	set.monitors[m.Name] = m
+	m.status.Ready()
+	set.Ready()
+	m.status.Checked(time.Now(), errors.New("timed out"), 2)
+	if code(readyzHandler) != http.StatusOK || code(healthzHandler) != http.StatusOK {
+		t.Errorf("expected live and ready after a check")
+	}
+
+	m.status.Checked(time.Now().Add(-2*livenessTimeout), nil, 0)
+	if code(healthzHandler) != http.StatusServiceUnavailable {
+		t.Errorf("expected a stalled check loop to fail liveness")
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	m, restore := newTestMonitor(newFakeEC2())
+	defer restore()
+	_, restoreMonitors := withMonitors(m)
+	defer restoreMonitors()
+
+	m.status.Checked(time.Now(), errors.New("timed out"), 5)
+	ev := testEvent()
+	m.status.Dispatched(ev)
+
+	w := httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/status", nil))
+
+	var report StatusReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Monitors) != 1 {
+		t.Fatalf("expected one monitor, got %+v", report)
+	}
+	mr := report.Monitors[0]
+	if mr.Monitor != "test" || mr.State != stateFailed || mr.LastCheckOK || mr.ConsecutiveFailures != 5 {
+		t.Errorf("unexpected report %+v", mr)
+	}
+	if mr.RouteTable.Expected != "rtb-primary" || mr.RouteTable.Secondary != "rtb-secondary" {
+		t.Errorf("unexpected route tables %+v", mr.RouteTable)
+	}
+	if mr.LastEvent == nil || mr.LastEvent.Kind != eventFailoverFailed || len(mr.LastEvent.Results) != 1 {
+		t.Errorf("unexpected last event %+v", mr.LastEvent)
+	}
+}
+
+func TestStatusReportObservesRouteTable(t *testing.T) {
+	f := newFakeEC2()
+	m, restore := newTestMonitor(f)
+	defer restore()
+
+	// Changed outside the monitor, and seen by a drift check
+	f.associations["subnet-1"] = "rtb-secondary"
+	if _, err := m.associatedRouteTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rt := m.Report().RouteTable
+	if rt.Expected != "rtb-primary" || rt.Observed != "rtb-secondary" || rt.ObservedAt == nil {
+		t.Errorf("unexpected route tables %+v", rt)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	notifyDedupWindow    time.Duration
+	notifyRateLimit      int
+	notifyRatePeriod     time.Duration
+	notifyDigestInterval time.Duration
+
+	notificationsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "natcheck_notification_suppressed_total",
+		Help: "The count of notifications held back, by channel and reason",
+	},
+		[]string{"subnet", "channel", "reason"},
+	)
+)
+
+func init() {
+	flag.DurationVar(&notifyDedupWindow, "notify-dedup-window", getEnvMs("NAT_NOTIFY_DEDUP_WINDOW_MS", 600000), "Window in which repeats of the same event for the same subnet are suppressed, in milliseconds")
+	flag.IntVar(&notifyRateLimit, "notify-rate-limit", getEnvInt("NAT_NOTIFY_RATE_LIMIT", 10), "Maximum number of notifications each channel sends per rate period, 0 for no limit")
+	flag.DurationVar(&notifyRatePeriod, "notify-rate-period", getEnvMs("NAT_NOTIFY_RATE_PERIOD_MS", 3600000), "Period over which the notification rate limit applies, in milliseconds")
+	flag.DurationVar(&notifyDigestInterval, "notify-digest-interval", getEnvMs("NAT_NOTIFY_DIGEST_INTERVAL_MS", 900000), "Interval at which suppressed notifications are sent as a digest in milliseconds, 0 to drop them")
+
+	prometheus.MustRegister(notificationsSuppressed)
+}
+
+const (
+	suppressedDuplicate   = "duplicate"
+	suppressedRateLimited = "rate-limited"
+)
+
+// throttle sits in front of a notifier, suppressing duplicate events and
+// anything beyond the channel's rate limit. Suppressed events are rolled
+// into a periodic digest.
+type throttle struct {
+	name   string
+	action Action
+	dedup  time.Duration
+	limit  int
+	period time.Duration
+	digest time.Duration
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+	sent     []time.Time
+	pending  []SuppressedEvent
+}
+
+// throttles holds every throttle so that their digests can be sent, once
+// digestCtx is set by startDigests.
+var (
+	throttlesMu sync.Mutex
+	throttles   []*throttle
+	digestCtx   context.Context
+)
+
+// newThrottle wraps a notifier with its throttle. The defaults can be
+// overridden per notifier with NAT_NOTIFY_<NAME>_DEDUP_WINDOW_MS,
+// NAT_NOTIFY_<NAME>_RATE_LIMIT and NAT_NOTIFY_<NAME>_DIGEST_INTERVAL_MS.
+func newThrottle(name string, action Action) *throttle {
+	key := "NAT_NOTIFY_" + envName(name)
+	t := &throttle{
+		name:     name,
+		action:   action,
+		dedup:    getEnvMs(key+"_DEDUP_WINDOW_MS", int(notifyDedupWindow/time.Millisecond)),
+		limit:    getEnvInt(key+"_RATE_LIMIT", notifyRateLimit),
+		period:   notifyRatePeriod,
+		digest:   getEnvMs(key+"_DIGEST_INTERVAL_MS", int(notifyDigestInterval/time.Millisecond)),
+		lastSent: make(map[string]time.Time),
+	}
+	throttlesMu.Lock()
+	defer throttlesMu.Unlock()
+	throttles = append(throttles, t)
+	if digestCtx != nil {
+		t.startDigest(digestCtx)
+	}
+	return t
+}
+
+// setAction replaces the notifier, keeping what has been sent through it.
+func (t *throttle) setAction(action Action) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.action = action
+}
+
+func (t *throttle) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	kind := ev.Lifecycle()
+
+	t.mu.Lock()
+	action := t.action
+	reason := t.suppress(kind, ev.Subnet, ev.Time)
+	if reason != "" {
+		if t.digest > 0 {
+			t.pending = append(t.pending, SuppressedEvent{
+				Kind:      kind,
+				Monitor:   ev.Monitor,
+				Subnet:    ev.Subnet,
+				Time:      ev.Time,
+				LastError: ev.LastError,
+				Reason:    reason,
+			})
+		}
+		t.mu.Unlock()
+
+		glog.Infof("Suppressed %v notification to %v: %v", kind, t.name, reason)
+		notificationsSuppressed.WithLabelValues(ev.Monitor, t.name, reason).Inc()
+		return Result{"suppressed": reason}, errSkipped
+	}
+	t.mu.Unlock()
+
+	res, err := action.Trigger(ctx, ev)
+	if err != nil {
+		// Only deliveries count, so that a retry isn't taken for a duplicate
+		return res, err
+	}
+	t.mu.Lock()
+	t.lastSent[ev.Subnet+"/"+kind] = ev.Time
+	t.sent = append(t.sent, ev.Time)
+	t.mu.Unlock()
+	return res, nil
+}
+
+// suppress returns why the event should not be sent, if it shouldn't. Only
+// notifications of problems are suppressed, so that a recovery is never
+// held back after its failure was reported.
+func (t *throttle) suppress(kind, subnet string, now time.Time) string {
+	if kind == eventRecovered || kind == eventFailedBack {
+		return ""
+	}
+
+	if last, ok := t.lastSent[subnet+"/"+kind]; ok && now.Sub(last) < t.dedup {
+		return suppressedDuplicate
+	}
+
+	if t.limit > 0 {
+		recent := t.sent[:0]
+		for _, sent := range t.sent {
+			if now.Sub(sent) < t.period {
+				recent = append(recent, sent)
+			}
+		}
+		t.sent = recent
+		if len(t.sent) >= t.limit {
+			return suppressedRateLimited
+		}
+	}
+	return ""
+}
+
+// flush sends a digest of the events suppressed since the last one.
+func (t *throttle) flush(ctx context.Context, now time.Time) {
+	t.mu.Lock()
+	action := t.action
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	glog.Infof("Sending digest of %v suppressed notifications to %v", len(pending), t.name)
+	ev := &Event{
+		Kind:       eventDigest,
+		Time:       now,
+		Suppressed: pending,
+	}
+	// A digest may cover several monitors
+	var names, subnets []string
+	for _, s := range pending {
+		if !stringIn(s.Monitor, names) {
+			names = append(names, s.Monitor)
+		}
+		if !stringIn(s.Subnet, subnets) {
+			subnets = append(subnets, s.Subnet)
+		}
+	}
+	ev.Monitor, ev.Subnet = strings.Join(names, ", "), strings.Join(subnets, ", ")
+	runAction(ctx, t.name, action, policyFor(t.name), ev)
+}
+
+// startDigests sends each throttle's digests until the context is
+// cancelled, including those of throttles created later.
+func startDigests(ctx context.Context) {
+	throttlesMu.Lock()
+	defer throttlesMu.Unlock()
+	digestCtx = ctx
+	for _, t := range throttles {
+		t.startDigest(ctx)
+	}
+}
+
+func (t *throttle) startDigest(ctx context.Context) {
+	if t.digest <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(t.digest)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				t.flush(ctx, now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func formatSuppressed(events []SuppressedEvent) string {
+	var buf bytes.Buffer
+	for _, s := range events {
+		fmt.Fprintf(&buf, "  %v %v %v (%v)", s.Time.UTC().Format(time.RFC3339), s.Subnet, s.Kind, s.Reason)
+		if s.LastError != "" {
+			fmt.Fprintf(&buf, ": %v", s.LastError)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
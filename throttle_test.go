@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottleSuppressesAndDigests(t *testing.T) {
+	var sent []*Event
+	notifier := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		sent = append(sent, ev)
+		return nil, nil
+	})
+	th := &throttle{
+		name:     "test",
+		action:   notifier,
+		dedup:    10 * time.Minute,
+		limit:    3,
+		period:   time.Hour,
+		digest:   time.Hour,
+		lastSent: make(map[string]time.Time),
+	}
+
+	now := time.Now()
+	steps := []struct {
+		kind   string
+		subnet string
+		at     time.Duration
+		want   int
+	}{
+		{eventDrift, "subnet-1", 0, 1},
+		{eventDrift, "subnet-1", time.Minute, 1}, // duplicate
+		{eventDrift, "subnet-2", time.Minute, 2}, // different subnet
+		{eventDegraded, "subnet-1", 2 * time.Minute, 3},
+		{eventDrift, "subnet-1", 20 * time.Minute, 3}, // rate limited
+		{eventRecovered, "subnet-1", 21 * time.Minute, 4},
+		{eventDrift, "subnet-1", 2 * time.Hour, 5}, // limit has passed
+	}
+	for i, step := range steps {
+		th.Trigger(context.Background(), &Event{Kind: step.kind, Subnet: step.subnet, Time: now.Add(step.at)})
+		if len(sent) != step.want {
+			t.Errorf("step %v (%v): expected %v notifications, got %v", i, step.kind, step.want, len(sent))
+		}
+	}
+
+	th.flush(context.Background(), now.Add(3*time.Hour))
+	if len(sent) != 6 {
+		t.Fatalf("expected a digest to be sent")
+	}
+	digest := sent[5]
+	if digest.Lifecycle() != eventDigest || len(digest.Suppressed) != 2 || digest.Subnet != "subnet-1" {
+		t.Fatalf("unexpected digest %+v", digest)
+	}
+	if digest.Suppressed[0].Reason != suppressedDuplicate || digest.Suppressed[1].Reason != suppressedRateLimited {
+		t.Errorf("unexpected suppressed events %+v", digest.Suppressed)
+	}
+
+	th.flush(context.Background(), now.Add(4*time.Hour))
+	if len(sent) != 6 {
+		t.Errorf("expected no digest without suppressed events")
+	}
+}
+
+func TestThrottleRetriesFailedDelivery(t *testing.T) {
+	attempts := 0
+	notifier := makeAction(func(ctx context.Context, ev *Event) (Result, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	})
+	th := &throttle{
+		name:     "test",
+		action:   notifier,
+		dedup:    10 * time.Minute,
+		limit:    1,
+		period:   time.Hour,
+		lastSent: make(map[string]time.Time),
+	}
+	policy := actionPolicy{retry: backoff{attempts: 2, base: time.Millisecond, max: time.Millisecond}}
+
+	now := time.Now()
+	res := runAction(context.Background(), "test", th, policy, &Event{Kind: eventFailed, Subnet: "subnet-1", Time: now})
+	if res.Status != resultSuccess || attempts != 2 {
+		t.Fatalf("expected the retry to be delivered, got %+v after %v attempts", res, attempts)
+	}
+
+	res = runAction(context.Background(), "test", th, policy, &Event{Kind: eventFailed, Subnet: "subnet-1", Time: now.Add(time.Minute)})
+	if res.Status != resultSkipped || attempts != 2 {
+		t.Errorf("expected the delivered notification to count, got %+v after %v attempts", res, attempts)
+	}
+}
+
+func TestDigestRendersInChatTemplates(t *testing.T) {
+	ev := &Event{
+		Kind:       eventDigest,
+		Monitor:    "eu-west-1a",
+		Subnet:     "subnet-1",
+		Time:       time.Now(),
+		Suppressed: []SuppressedEvent{{Kind: eventDrift, Subnet: "subnet-1", Time: time.Now(), Reason: suppressedDuplicate}},
+	}
+	for kind, tmpl := range map[string]string{"slack": defaultSlackTemplate, "teams": defaultTeamsTemplate} {
+		c, err := newChatAction(kind, &secret{value: "http://unused"}, "", tmpl)
+		if err != nil {
+			t.Fatalf("%v: %v", kind, err)
+		}
+		body, err := c.render(ev)
+		if err != nil {
+			t.Fatalf("%v: %v", kind, err)
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Errorf("%v: %v", kind, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/pkg/errors"
+)
+
+// validation reports the outcome of each preflight check as it is made.
+type validation struct {
+	out    io.Writer
+	passed int
+	failed int
+}
+
+func (v *validation) check(what string, err error) bool {
+	if err != nil {
+		v.failed++
+		fmt.Fprintf(v.out, "FAIL  %v: %v\n", what, err)
+		return false
+	}
+	v.passed++
+	fmt.Fprintf(v.out, "PASS  %v\n", what)
+	return true
+}
+
+// validator makes the preflight checks, so that tests can do without EC2
+// and ICMP.
+type validator struct {
+	newClient func(subnet string) ec2iface.EC2API
+	probe     func(host string, timeout time.Duration) error
+	timeout   time.Duration
+}
+
+// validateCommand checks the configuration, the resources it refers to and
+// our permission to change them, without changing anything.
+func validateCommand(args []string) int {
+	budget = newFailoverBudget()
+	v := &validator{
+		newClient: newEC2Client,
+		probe: func(host string, timeout time.Duration) error {
+			return <-checkEndpoint(host, timeout)
+		},
+		timeout: 30 * time.Second,
+	}
+	res := v.run(os.Stdout)
+	fmt.Printf("\n%v passed, %v failed\n", res.passed, res.failed)
+	if res.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (v *validator) run(out io.Writer) *validation {
+	res := &validation{out: out}
+
+	cfg, err := loadConfig()
+	if !res.check("configuration is valid", err) {
+		return res
+	}
+	if !res.check("global settings apply", cfg.apply(true)) {
+		return res
+	}
+	for _, mc := range cfg.Monitors {
+		v.monitor(res, newMonitor(mc, v.newClient(mc.Subnet)))
+	}
+	v.notifiers(res)
+	return res
+}
+
+// call runs an EC2 check with the validator's timeout.
+func (v *validator) call(f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+	return f(ctx)
+}
+
+func (v *validator) monitor(res *validation, m *Monitor) {
+	prefix := "monitor " + m.Name + ": "
+
+	subnetOK := res.check(prefix+"subnet "+m.Subnet+" exists", v.call(m.validateSubnetId))
+	primaryOK := res.check(prefix+"primary route table "+m.Primary+" exists", v.call(func(ctx context.Context) error {
+		return m.validateRouteTableId(ctx, m.Primary, "primary")
+	}))
+	secondaryOK := res.check(prefix+"secondary route table "+m.Secondary+" exists", v.call(func(ctx context.Context) error {
+		return m.validateRouteTableId(ctx, m.Secondary, "secondary")
+	}))
+
+	if subnetOK && primaryOK && secondaryOK {
+		var current string
+		err := v.call(func(ctx context.Context) error {
+			var err error
+			current, err = m.associatedRouteTable(ctx)
+			if err == nil && current != m.Primary && current != m.Secondary {
+				err = fmt.Errorf("subnet uses %v, which is neither the primary nor the secondary", current)
+			}
+			return err
+		})
+		if res.check(prefix+"subnet is associated with a configured route table", err) {
+			v.permissions(res, prefix, m, current)
+		}
+	}
+
+	if _, err := net.LookupHost(m.Probe.Target); res.check(prefix+"target "+m.Probe.Target+" resolves", err) {
+		res.check(prefix+"target "+m.Probe.Target+" answers", v.probe(m.Probe.Target, time.Duration(m.Probe.Timeout)))
+	}
+}
+
+// permissions checks that we may make the calls a failover and failback
+// would, using DryRun requests.
+func (v *validator) permissions(res *validation, prefix string, m *Monitor, current string) {
+	err := v.call(func(ctx context.Context) error {
+		associationId, err := m.findAssociationId(ctx, current)
+		if err != nil {
+			return err
+		}
+		return dryRunPermitted(ec2Call(ctx, m.Name, "DisassociateRouteTable", func() error {
+			_, err := m.c.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{
+				DryRun:        aws.Bool(true),
+				AssociationId: &associationId,
+			})
+			return err
+		}))
+	})
+	res.check(prefix+"may disassociate "+current, err)
+
+	for _, table := range []string{m.Primary, m.Secondary} {
+		table := table
+		err := v.call(func(ctx context.Context) error {
+			return dryRunPermitted(ec2Call(ctx, m.Name, "AssociateRouteTable", func() error {
+				_, err := m.c.AssociateRouteTable(&ec2.AssociateRouteTableInput{
+					DryRun:       aws.Bool(true),
+					RouteTableId: &table,
+					SubnetId:     &m.Subnet,
+				})
+				return err
+			}))
+		})
+		res.check(prefix+"may associate "+table, err)
+	}
+}
+
+// dryRunPermitted interprets the response to a DryRun request, which fails
+// with DryRunOperation if the real request would have been allowed.
+func dryRunPermitted(err error) error {
+	switch awsErrorCode(err) {
+	case "DryRunOperation":
+		return nil
+	case "OK":
+		return errors.New("the request was not treated as a dry run")
+	case "UnauthorizedOperation":
+		return errors.Wrap(err, "not permitted")
+	}
+	return err
+}
+
+// notifiers checks the configuration of every notifier that is set up.
+func (v *validator) notifiers(res *validation) {
+	if smtpServer+smtpUsername+smtpPassword.Get()+smtpSource+smtpTarget != "" {
+		_, err := newEmailAction()
+		if res.check("email is configured", err) {
+			conn, err := net.DialTimeout("tcp", smtpServer, smtpTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			res.check("SMTP server "+smtpServer+" accepts connections", err)
+		}
+	}
+
+	for _, u := range splitList(webhookURLs) {
+		res.check("webhook URL for "+webhookName(u)+" is valid", checkURL(u))
+	}
+	if webhookURLs != "" {
+		_, err := parseHeaders(webhookHeaders.Get())
+		res.check("webhook headers are valid", err)
+	}
+
+	for _, chat := range []struct {
+		kind, templateFile, defaultTemplate string
+		url                                 *secret
+	}{
+		{"slack", slackTemplate, defaultSlackTemplate, &slackURL},
+		{"teams", teamsTemplate, defaultTeamsTemplate, &teamsURL},
+	} {
+		if chat.url.Get() == "" {
+			continue
+		}
+		_, err := newChatAction(chat.kind, chat.url, chat.templateFile, chat.defaultTemplate)
+		if err == nil {
+			if err = checkURL(chat.url.Get()); err != nil {
+				// The URL is the credential
+				err = errors.New(chat.url.redact(err.Error()))
+			}
+		}
+		res.check(chat.kind+" is configured", err)
+	}
+
+	if incidentRoutingKey.Get() != "" {
+		res.check("incident URL "+incidentURL+" is valid", checkURL(incidentURL))
+	}
+
+	if fields := strings.Fields(execCommand); len(fields) > 0 {
+		_, err := exec.LookPath(fields[0])
+		res.check("exec command "+fields[0]+" exists", err)
+	}
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if urlErr, ok := err.(*url.Error); ok {
+		// Leave out the URL, which may include a token
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("expected an http or https URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("no host given")
+	}
+	return nil
+}
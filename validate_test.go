@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// unauthorizedEC2 denies associating route tables.
+type unauthorizedEC2 struct {
+	*fakeEC2
+}
+
+func (f unauthorizedEC2) AssociateRouteTable(in *ec2.AssociateRouteTableInput) (*ec2.AssociateRouteTableOutput, error) {
+	return nil, awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+}
+
+// withConfigFile writes the config file, returning a function that removes
+// it and restores the globals.
+func withConfigFile(t *testing.T, config string) func() {
+	dir, cleanup := tempDir(t)
+	path := filepath.Join(dir, "nat.json")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	oldFile, oldBudget := configFile, budget
+	configFile, budget = path, newFailoverBudget()
+	return func() {
+		configFile, budget = oldFile, oldBudget
+		cleanup()
+	}
+}
+
+func runValidator(c ec2iface.EC2API) (*validation, string) {
+	v := &validator{
+		newClient: func(string) ec2iface.EC2API { return c },
+		probe:     func(string, time.Duration) error { return nil },
+		timeout:   time.Second,
+	}
+	var out bytes.Buffer
+	return v.run(&out), out.String()
+}
+
+func TestValidate(t *testing.T) {
+	defer withConfigFile(t, `{"monitors": [
+		{"name": "a", "subnet": "subnet-1", "primary": "rtb-primary", "secondary": "rtb-secondary",
+		 "probe": {"target": "localhost"}}
+	]}`)()
+
+	res, out := runValidator(newFakeEC2())
+	if res.failed != 0 || res.passed == 0 {
+		t.Errorf("expected every check to pass, got:\n%v", out)
+	}
+	for _, want := range []string{"may disassociate rtb-primary", "may associate rtb-secondary", "target localhost answers"} {
+		if !strings.Contains(out, "PASS  monitor a: "+want) {
+			t.Errorf("expected %q to pass, got:\n%v", want, out)
+		}
+	}
+
+	res, out = runValidator(unauthorizedEC2{newFakeEC2()})
+	if res.failed != 2 || !strings.Contains(out, "FAIL  monitor a: may associate rtb-secondary: not permitted") {
+		t.Errorf("expected both associations to be reported as not permitted, got:\n%v", out)
+	}
+}
+
+func TestValidateMissingResources(t *testing.T) {
+	defer withConfigFile(t, `{"monitors": [
+		{"name": "a", "subnet": "subnet-1", "primary": "rtb-primary", "secondary": "rtb-missing",
+		 "probe": {"target": "localhost"}}
+	]}`)()
+
+	res, out := runValidator(newFakeEC2())
+	if res.failed != 1 || !strings.Contains(out, "FAIL  monitor a: secondary route table rtb-missing exists") {
+		t.Errorf("expected the missing route table to be reported, got:\n%v", out)
+	}
+	if strings.Contains(out, "may associate") {
+		t.Errorf("expected permissions not to be checked without the route tables, got:\n%v", out)
+	}
+
+	defer withConfigFile(t, `{"monitors": []}`)()
+	if res, out := runValidator(newFakeEC2()); res.failed != 1 || !strings.Contains(out, "FAIL  configuration is valid") {
+		t.Errorf("expected the invalid configuration to be reported, got:\n%v", out)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const webhookSignatureHeader = "X-Nat-Signature"
+
+var (
+	webhookURLs     string
+	webhookHeaders  secret
+	webhookSecret   secret
+	webhookTimeout  time.Duration
+	webhookAttempts int
+)
+
+func init() {
+	flag.StringVar(&webhookURLs, "webhook-urls", getEnv("NAT_WEBHOOK_URLS", ""), "Comma separated URLs to POST JSON alerts to")
+	secretVar(&webhookHeaders, "webhook-headers", "NAT_WEBHOOK_HEADERS", "Comma separated Name=Value headers added to webhook requests")
+	secretVar(&webhookSecret, "webhook-secret", "NAT_WEBHOOK_SECRET", "Key used to sign webhook bodies with HMAC-SHA256")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", getEnvMs("NAT_WEBHOOK_TIMEOUT_MS", 5000), "Timeout for each webhook request in milliseconds")
+	flag.IntVar(&webhookAttempts, "webhook-attempts", getEnvInt("NAT_WEBHOOK_ATTEMPTS", 3), "Number of attempts for each webhook URL")
+}
+
+// webhookPayload is the JSON document sent to webhook receivers.
+type webhookPayload struct {
+	Kind    string         `json:"kind"`
+	Event   *Event         `json:"event"`
+	Results []ActionResult `json:"results"`
+}
+
+func newWebhookPayload(ev *Event) webhookPayload {
+	return webhookPayload{Kind: ev.Lifecycle(), Event: ev, Results: ev.Results()}
+}
+
+type webhookAction struct {
+	urls    []string
+	headers *secret // parsed for each event, as they may hold credentials
+	key     *secret
+	client  *http.Client
+	retry   backoff
+}
+
+func makeWebhookAction() (Action, error) {
+	urls := splitList(webhookURLs)
+	if len(urls) == 0 {
+		glog.Infof("Skipping webhook action due to absent configuration")
+		return nil, nil
+	}
+
+	if _, err := parseHeaders(webhookHeaders.Get()); err != nil {
+		return nil, errors.Wrap(err, "invalid webhook headers")
+	}
+
+	return &webhookAction{
+		urls:    urls,
+		headers: &webhookHeaders,
+		key:     &webhookSecret,
+		client:  &http.Client{Timeout: webhookTimeout},
+		retry:   backoff{attempts: webhookAttempts, base: 500 * time.Millisecond, max: 5 * time.Second},
+	}, nil
+}
+
+func (w *webhookAction) Trigger(ctx context.Context, ev *Event) (Result, error) {
+	body, err := json.Marshal(newWebhookPayload(ev))
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding webhook payload failed")
+	}
+
+	headers, err := parseHeaders(w.headers.Get())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid webhook headers")
+	}
+	if key := w.key.Get(); key != "" {
+		headers.Set(webhookSignatureHeader, signBody([]byte(key), body))
+	}
+
+	res := Result{}
+	var failed []string
+	for i, target := range w.urls {
+		name := webhookName(target)
+		if _, ok := res[name]; ok {
+			name += "#" + strconv.Itoa(i+1)
+		}
+		if dryRun {
+			glog.Infof("Would be posting to %v: %s", name, body)
+			res[name] = "dry-run"
+			continue
+		}
+
+		err := w.retry.retry(ctx, isRetryableWebhookError, func() error {
+			return postJSON(ctx, w.client, target, headers, body)
+		})
+		if err != nil {
+			glog.Errorf("Webhook %v failed: %v", name, err)
+			res[name] = err.Error()
+			failed = append(failed, name)
+			continue
+		}
+		res[name] = "delivered"
+	}
+
+	if len(failed) > 0 {
+		return res, fmt.Errorf("webhook delivery failed for %v", strings.Join(failed, ", "))
+	}
+	return res, nil
+}
+
+// webhookName identifies a webhook in results and logs by its host, as its
+// URL may include a token.
+func webhookName(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "webhook"
+	}
+	return u.Host
+}
+
+// webhookStatusError is returned for non-2xx responses.
+type webhookStatusError struct {
+	code int
+}
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %v %v", e.code, http.StatusText(e.code))
+}
+
+func isRetryableWebhookError(err error) bool {
+	if statusErr, ok := err.(webhookStatusError); ok {
+		return statusErr.code >= 500 || statusErr.code == http.StatusTooManyRequests
+	}
+	return err != context.Canceled && err != context.DeadlineExceeded
+}
+
+// postJSON sends body to target, treating any non-2xx response as an error.
+// Errors leave out the URL, which may include a token.
+func postJSON(ctx context.Context, client *http.Client, target string, headers http.Header, body []byte) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return errors.New("invalid URL")
+	}
+	req = req.WithContext(ctx)
+
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return webhookStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// signBody returns the value of the signature header for body, which
+// receivers can verify by computing the same HMAC with the shared secret.
+func signBody(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseHeaders parses a comma separated list of Name=Value pairs.
+func parseHeaders(s string) (http.Header, error) {
+	headers := http.Header{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("expected Name=Value, got %q", pair)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	var received webhookPayload
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if sig := r.Header.Get(webhookSignatureHeader); sig != signBody([]byte("s3cret"), body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		if r.Header.Get("X-Team") != "networking" {
+			t.Errorf("expected custom header, got %v", r.Header)
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	w := &webhookAction{
+		urls:    []string{srv.URL},
+		headers: &secret{value: "X-Team=networking"},
+		key:     &secret{value: "s3cret"},
+		client:  &http.Client{Timeout: time.Second},
+		retry:   backoff{attempts: 3, base: time.Millisecond, max: time.Millisecond},
+	}
+
+	ev := &Event{Kind: eventFailed, Monitor: "eu-west-1a", Subnet: "subnet-1", From: stateHealthy, To: stateFailed, ConsecutiveFailures: 5}
+	ev.AddResult(ActionResult{Action: "routetable", Status: resultSuccess})
+	res, err := w.Trigger(context.Background(), ev)
+	if err != nil {
+		t.Fatalf("expected delivery, got %v (%v)", err, res)
+	}
+
+	if calls != 2 {
+		t.Errorf("expected a retry after the 503, got %v calls", calls)
+	}
+	if received.Kind != eventFailedOver || received.Event.ConsecutiveFailures != 5 || len(received.Results) != 1 {
+		t.Errorf("unexpected payload %+v", received)
+	}
+}
+
+func TestWebhookPermanentFailure(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	w := &webhookAction{
+		urls:   []string{srv.URL},
+		client: &http.Client{Timeout: time.Second},
+		retry:  backoff{attempts: 3, base: time.Millisecond, max: time.Millisecond},
+	}
+	if _, err := w.Trigger(context.Background(), &Event{}); err == nil || calls != 1 {
+		t.Errorf("expected a single failed attempt, got %v calls and %v", calls, err)
+	}
+}
+
+func TestWebhookResultsLeaveOutURLs(t *testing.T) {
+	oldDryRun := dryRun
+	dryRun = false
+	defer func() { dryRun = oldDryRun }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	w := &webhookAction{
+		urls:   []string{srv.URL + "/hooks/s3cret", srv.URL + "/hooks/t0ken"},
+		client: &http.Client{Timeout: time.Second},
+		retry:  backoff{attempts: 3, base: time.Millisecond, max: time.Millisecond},
+	}
+	res, err := w.Trigger(ctx, &Event{})
+	if err == nil || calls != 1 {
+		t.Errorf("expected the cancelled delivery not to be retried, got %v calls and %v", calls, err)
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	if _, ok := res[host]; !ok || len(res) != 2 {
+		t.Errorf("expected results keyed by host, got %v", res)
+	}
+	for name, outcome := range res {
+		if strings.Contains(name+outcome+err.Error(), "/hooks/") {
+			t.Errorf("expected the URLs to be left out, got %v: %v (%v)", name, outcome, err)
+		}
+	}
+}